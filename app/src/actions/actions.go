@@ -4,8 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"go-auth/src/auth"
+	"go-auth/src/session"
 	"go-auth/src/store"
+	"go-auth/src/verifier"
+	"net"
 	"net/http"
+	"strings"
 )
 
 //HTTPAction is extended HttpHandler which returns http status of response and data
@@ -42,6 +46,35 @@ func Run(action HTTPAction, method string) func(w http.ResponseWriter, r *http.R
 	}
 }
 
+//RunAuthenticated midleware for running actions which require valid auth token.
+//Requests with another method are rejected before the token is checked, requests without token are answered
+//by verifier.Unauthorized.
+//Verified claim is available in action via auth.FromContext(r.Context())
+func RunAuthenticated(action HTTPAction, method string) func(w http.ResponseWriter, r *http.Request) {
+	run := Run(action, method)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		token, err := verifier.BearerToken(r)
+		if err != nil {
+			verifier.Unauthorized(w, err)
+			return
+		}
+
+		claim, err := auth.Verify(token)
+		if err != nil {
+			verifier.Unauthorized(w, err)
+			return
+		}
+
+		run(w, r.WithContext(auth.NewContext(r.Context(), claim)))
+	}
+}
+
 type healthCheckResponse struct {
 	Status  string `json:"status"`
 	Message string `json:"message"`
@@ -54,6 +87,11 @@ func Healthcheck(r *http.Request) (int, interface{}) {
 	return http.StatusOK, response
 }
 
+//JWKS publishes public keys for tokens verification
+func JWKS(r *http.Request) (int, interface{}) {
+	return http.StatusOK, auth.PublicKeys()
+}
+
 //Registration action for service
 func Registration(r *http.Request) (int, interface{}) {
 	var user store.User
@@ -64,7 +102,9 @@ func Registration(r *http.Request) (int, interface{}) {
 		return http.StatusBadRequest, nil
 	}
 
-	if ok, validationErrors, err := user.Create(); !ok {
+	if ok, validationErrors, err := user.Create(); err == store.ErrEmailTaken || err == store.ErrNicknameTaken {
+		return http.StatusConflict, validationErrors
+	} else if !ok {
 		return http.StatusUnprocessableEntity, validationErrors
 	} else if err != nil {
 		return http.StatusInternalServerError, err
@@ -84,14 +124,174 @@ func Login(r *http.Request) (int, interface{}) {
 	if valid, errors := creds.Create(); !valid {
 		return http.StatusUnprocessableEntity, errors
 	}
+	creds.IP = clientIP(r)
+	creds.UserAgent = r.UserAgent()
 	token, err := creds.Authorize()
-	if err != nil {
+	if err == session.ErrSessionLimit {
+		return http.StatusConflict, map[string]string{"error": err.Error()}
+	} else if err != nil {
 		return http.StatusInternalServerError, err
 	}
 
 	return http.StatusOK, token
 }
 
+type renewRequest struct {
+	RenewToken string `json:"renew_token"`
+}
+
+//Refresh exchanges renew token for the new pair of tokens
+func Refresh(r *http.Request) (int, interface{}) {
+	var req renewRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil || req.RenewToken == "" {
+		return http.StatusBadRequest, nil
+	}
+
+	token, err := auth.Renew(req.RenewToken, clientIP(r), r.UserAgent())
+	if err == auth.ErrInvalidRenewToken || err == auth.ErrRenewTokenReused || err == session.ErrClientMismatch {
+		return http.StatusUnauthorized, map[string]string{
+			"renew_token": err.Error(),
+		}
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, token
+}
+
+//Logout ends session of the renew token
+func Logout(r *http.Request) (int, interface{}) {
+	var req renewRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil || req.RenewToken == "" {
+		return http.StatusBadRequest, nil
+	}
+
+	err := auth.Logout(req.RenewToken)
+	if err == auth.ErrInvalidRenewToken {
+		return http.StatusUnauthorized, map[string]string{
+			"renew_token": err.Error(),
+		}
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+//LogoutAll ends all sessions of the authenticated user. Users are identified by immutable subject of the claim,
+//so token issued before email change can't act on account which took the old email
+func LogoutAll(r *http.Request) (int, interface{}) {
+	claim, _ := auth.FromContext(r.Context())
+
+	if err := auth.LogoutAll(claim.Subject); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+//ChangePassword replaces password of the authenticated user and ends all user sessions
+func ChangePassword(r *http.Request) (int, interface{}) {
+	claim, _ := auth.FromContext(r.Context())
+
+	var change auth.PasswordChange
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&change); err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	if ok, validationErrors, err := change.Apply(claim.Subject); err == store.ErrUserNotFound {
+		return http.StatusUnauthorized, map[string]string{"error": err.Error()}
+	} else if !ok {
+		return http.StatusUnprocessableEntity, validationErrors
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+//ChangeEmail replaces email of the authenticated user and ends all user sessions
+func ChangeEmail(r *http.Request) (int, interface{}) {
+	claim, _ := auth.FromContext(r.Context())
+
+	var change auth.EmailChange
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&change); err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	if ok, validationErrors, err := change.Apply(claim.Subject); err == store.ErrUserNotFound {
+		return http.StatusUnauthorized, map[string]string{"error": err.Error()}
+	} else if !ok {
+		return http.StatusUnprocessableEntity, validationErrors
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+//Sessions lists active sessions of the authenticated user
+func Sessions(r *http.Request) (int, interface{}) {
+	claim, _ := auth.FromContext(r.Context())
+
+	active, err := auth.ActiveSessions(claim.Subject)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, active
+}
+
+//EndSession revokes session of the authenticated user by id from "/sessions/{id}" path
+func EndSession(r *http.Request) (int, interface{}) {
+	claim, _ := auth.FromContext(r.Context())
+
+	id := strings.TrimPrefix(r.URL.Path, "/sessions/")
+	if id == "" || strings.Contains(id, "/") {
+		return http.StatusNotFound, map[string]string{"error": auth.ErrSessionNotFound.Error()}
+	}
+
+	err := auth.EndSession(claim.Subject, id)
+	if err == auth.ErrSessionNotFound {
+		return http.StatusNotFound, map[string]string{"error": err.Error()}
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+//Revoke revokes auth or renew token according RFC 7009
+func Revoke(r *http.Request) (int, interface{}) {
+	if err := r.ParseForm(); err != nil {
+		return http.StatusBadRequest, map[string]string{"error": "invalid_request"}
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		return http.StatusBadRequest, map[string]string{"error": "invalid_request"}
+	}
+
+	if err := auth.Revoke(token, r.PostForm.Get("token_type_hint")); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+//clientIP returns address of the client without port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func internalError(w http.ResponseWriter, msg string) {
 	m := map[string]string{"error": msg}
 
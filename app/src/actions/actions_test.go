@@ -2,12 +2,17 @@ package actions
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"go-auth/src/auth"
+	"go-auth/src/session"
 	"go-auth/src/store"
+	"go-auth/src/verifier"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/dgrijalva/jwt-go"
@@ -94,6 +99,8 @@ func TestHealthcheck(t *testing.T) {
 
 type DefaultTestSuit struct {
 	suite.Suite
+
+	sessions *session.Manager
 }
 
 type RegistrationTestSuite struct {
@@ -108,6 +115,10 @@ func (suite *DefaultTestSuit) SetupSuite() {
 
 func (suite *DefaultTestSuit) SetupTest() {
 	store.CreateDefaultBacket()
+
+	suite.sessions = session.NewManager()
+	suite.sessions.Start(context.Background())
+	auth.UseSessions(suite.sessions)
 }
 
 func (suite *DefaultTestSuit) TearDownSuite() {
@@ -115,6 +126,7 @@ func (suite *DefaultTestSuit) TearDownSuite() {
 }
 
 func (suite *DefaultTestSuit) TearDownTest() {
+	suite.sessions.Stop()
 	store.DropDatabase()
 }
 
@@ -140,6 +152,38 @@ func (suite *RegistrationTestSuite) TestRegistration_WithValidParams() {
 	suite.Equal(result, nil)
 }
 
+func (suite *RegistrationTestSuite) TestRegistration_Twice() {
+	data, _ := json.Marshal(store.User{Email: "jhondoe@testmail.com", Password: "!strongPwd"})
+
+	request, _ := http.NewRequest(http.MethodPost, "/registration", bytes.NewReader(data))
+	status, _ := Registration(request)
+	suite.Equal(http.StatusCreated, status)
+
+	request, _ = http.NewRequest(http.MethodPost, "/registration", bytes.NewReader(data))
+	status, result := Registration(request)
+	suite.Equal(http.StatusConflict, status)
+	suite.Contains(result, "email")
+}
+
+func (suite *RegistrationTestSuite) TestRegistration_WithTakenNickname() {
+	data, _ := json.Marshal(store.User{Email: "jhondoe@testmail.com", Password: "!strongPwd", Nickname: "JD"})
+	request, _ := http.NewRequest(http.MethodPost, "/registration", bytes.NewReader(data))
+	status, _ := Registration(request)
+	suite.Equal(http.StatusCreated, status)
+
+	data, _ = json.Marshal(store.User{Email: "jhon@testmail.com", Password: "!strongPwd", Nickname: "jd"})
+	request, _ = http.NewRequest(http.MethodPost, "/registration", bytes.NewReader(data))
+	status, result := Registration(request)
+	suite.Equal(http.StatusConflict, status)
+	suite.Contains(result, "nickname")
+
+	data, _ = json.Marshal(store.User{Email: "jhon@testmail.com", Password: "!strongPwd", Nickname: "Admin"})
+	request, _ = http.NewRequest(http.MethodPost, "/registration", bytes.NewReader(data))
+	status, result = Registration(request)
+	suite.Equal(http.StatusUnprocessableEntity, status)
+	suite.Contains(result, "nickname")
+}
+
 func (suite *RegistrationTestSuite) TestRegistration_WithInvalidDate() {
 
 	user := store.User{
@@ -201,16 +245,16 @@ func (suite *LoginTestSuite) TestLogin_WithValidData() {
 	request, _ := http.NewRequest(http.MethodPost, "/login", bytes.NewReader(data))
 	status, tokens := Login(request)
 
-	tkns := tokens.(*auth.Claim)
+	tkns := tokens.(*auth.Tokens)
 
 	suite.Equal(http.StatusOK, status)
 	suite.NotEmpty(tkns.AuthToken)
 	suite.NotEmpty(tkns.RenewToken)
 
-	authUser := &auth.Claim{}
+	authUser := &auth.AccessClaim{}
 
 	tknAuth, _ := jwt.ParseWithClaims(tkns.AuthToken, authUser, func(token *jwt.Token) (interface{}, error) {
-		return []byte("jwt_secret_key"), nil
+		return auth.Keyfunc(token)
 	})
 	suite.True(tknAuth.Valid)
 	suite.Equal(suite.user.Email, authUser.Email)
@@ -218,11 +262,27 @@ func (suite *LoginTestSuite) TestLogin_WithValidData() {
 	suite.Equal(suite.user.FirstName, authUser.FirstName)
 	suite.Equal(suite.user.LastName, authUser.LastName)
 
-	tknRenew, _ := jwt.ParseWithClaims(tkns.RenewToken, authUser, func(token *jwt.Token) (interface{}, error) {
-		return []byte("jwt_secret_key"), nil
+	renewClaim := &auth.RefreshClaim{}
+	tknRenew, _ := jwt.ParseWithClaims(tkns.RenewToken, renewClaim, func(token *jwt.Token) (interface{}, error) {
+		return auth.Keyfunc(token)
 	})
 
 	suite.True(tknRenew.Valid)
+	suite.Equal(suite.user.ID, renewClaim.Subject)
+	suite.Equal("refresh", renewClaim.Type)
+	suite.NotEqual(authUser.Id, renewClaim.Id)
+}
+
+func (suite *LoginTestSuite) TestLogin_WithNickname() {
+	data, _ := json.Marshal(map[string]string{"login": "jd", "password": "!strongPwd"})
+	request, _ := http.NewRequest(http.MethodPost, "/login", bytes.NewReader(data))
+	status, tokens := Login(request)
+	suite.Equal(http.StatusOK, status)
+
+	claim, err := auth.Verify(tokens.(*auth.Tokens).AuthToken)
+	suite.Nil(err)
+	suite.Equal(suite.user.ID, claim.Subject)
+	suite.Equal(suite.user.Email, claim.Email)
 }
 
 func (suite *LoginTestSuite) TestLogin_WithInvalidEmail() {
@@ -262,4 +322,303 @@ func (suite *LoginTestSuite) TestLogin_WithEmptyData() {
 	status, _ := Login(request)
 
 	suite.Equal(http.StatusBadRequest, status)
-}
\ No newline at end of file
+}
+func (suite *LoginTestSuite) TestRefresh_WithValidToken() {
+	creds := auth.Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+	creds.Create()
+	tokens, _ := creds.Authorize()
+
+	data, _ := json.Marshal(map[string]string{"renew_token": tokens.RenewToken})
+	request, _ := http.NewRequest(http.MethodPost, "/refresh", bytes.NewReader(data))
+	status, result := Refresh(request)
+
+	suite.Equal(http.StatusOK, status)
+
+	tkns := result.(*auth.Tokens)
+	suite.NotEmpty(tkns.AuthToken)
+	suite.NotEmpty(tkns.RenewToken)
+
+	claim, err := auth.Verify(tkns.AuthToken)
+	suite.Nil(err)
+	suite.Equal(suite.user.Email, claim.Email)
+}
+
+func (suite *LoginTestSuite) TestRefresh_WithInvalidToken() {
+	data, _ := json.Marshal(map[string]string{"renew_token": "invalid.renew.token"})
+	request, _ := http.NewRequest(http.MethodPost, "/refresh", bytes.NewReader(data))
+	status, errors := Refresh(request)
+
+	suite.Equal(http.StatusUnauthorized, status)
+	suite.Contains(errors, "renew_token")
+}
+
+func (suite *LoginTestSuite) TestRefresh_WithEmptyData() {
+	request, _ := http.NewRequest(http.MethodPost, "/refresh", bytes.NewReader(nil))
+	status, _ := Refresh(request)
+
+	suite.Equal(http.StatusBadRequest, status)
+}
+
+func (suite *LoginTestSuite) TestLogout() {
+	creds := auth.Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+	creds.Create()
+	tokens, _ := creds.Authorize()
+
+	data, _ := json.Marshal(map[string]string{"renew_token": tokens.RenewToken})
+	request, _ := http.NewRequest(http.MethodPost, "/logout", bytes.NewReader(data))
+	status, _ := Logout(request)
+	suite.Equal(http.StatusOK, status)
+
+	request, _ = http.NewRequest(http.MethodPost, "/refresh", bytes.NewReader(data))
+	status, _ = Refresh(request)
+	suite.Equal(http.StatusUnauthorized, status)
+}
+
+func (suite *LoginTestSuite) TestRevoke() {
+	creds := auth.Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+	creds.Create()
+	tokens, _ := creds.Authorize()
+
+	form := url.Values{"token": {tokens.RenewToken}, "token_type_hint": {"refresh_token"}}
+	request, _ := http.NewRequest(http.MethodPost, "/revoke", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	status, _ := Revoke(request)
+	suite.Equal(http.StatusOK, status)
+
+	form = url.Values{"token": {tokens.AuthToken}, "token_type_hint": {"unknown"}}
+	request, _ = http.NewRequest(http.MethodPost, "/revoke", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	status, _ = Revoke(request)
+	suite.Equal(http.StatusOK, status, "unknown hint is ignored")
+	_, err := auth.Verify(tokens.AuthToken)
+	suite.Equal(verifier.ErrRevokedToken, err)
+}
+
+func TestJWKS(t *testing.T) {
+	rr := proccedRequest(http.MethodGet, Run(JWKS, http.MethodGet), t)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var jwks auth.JWKSet
+	json.NewDecoder(rr.Body).Decode(&jwks)
+
+	assert.Len(t, jwks.Keys, 1)
+	assert.Equal(t, "sig", jwks.Keys[0].Use)
+	assert.NotEmpty(t, jwks.Keys[0].Kid)
+}
+
+func (suite *LoginTestSuite) TestRunAuthenticated() {
+	creds := auth.Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+	creds.Create()
+	tokens, _ := creds.Authorize()
+
+	action := func(r *http.Request) (int, interface{}) {
+		claim, ok := auth.FromContext(r.Context())
+		suite.True(ok)
+		return http.StatusOK, map[string]string{"email": claim.Email}
+	}
+
+	request := func(method string, token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/test", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		RunAuthenticated(action, http.MethodGet)(rr, req)
+		return rr
+	}
+
+	rr := request(http.MethodGet, tokens.AuthToken)
+	suite.Equal(http.StatusOK, rr.Code)
+	suite.JSONEq(`{"email":"jhondoe@testmail.com"}`, rr.Body.String())
+
+	rr = request(http.MethodGet, "")
+	suite.Equal(http.StatusUnauthorized, rr.Code)
+	suite.Equal(`Bearer error="invalid_request"`, rr.Header().Get("WWW-Authenticate"))
+	for _, token := range []string{"invalid.auth.token", tokens.RenewToken} {
+		rr = request(http.MethodGet, token)
+		suite.Equal(http.StatusUnauthorized, rr.Code)
+		suite.Equal(`Bearer error="invalid_token"`, rr.Header().Get("WWW-Authenticate"))
+	}
+
+	for _, token := range []string{tokens.AuthToken, ""} {
+		rr = request(http.MethodPost, token)
+		suite.Equal(http.StatusMethodNotAllowed, rr.Code, "method is checked before token")
+		suite.Empty(rr.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func (suite *LoginTestSuite) TestLogoutAll() {
+	creds := auth.Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+	creds.Create()
+	first, _ := creds.Authorize()
+	second, _ := creds.Authorize()
+
+	request, _ := http.NewRequest(http.MethodPost, "/logout-all", nil)
+	request.Header.Set("Authorization", "Bearer "+second.AuthToken)
+	rr := httptest.NewRecorder()
+	RunAuthenticated(LogoutAll, http.MethodPost)(rr, request)
+	suite.Equal(http.StatusOK, rr.Code)
+
+	for _, token := range []string{first.RenewToken, second.RenewToken} {
+		data, _ := json.Marshal(map[string]string{"renew_token": token})
+		request, _ = http.NewRequest(http.MethodPost, "/refresh", bytes.NewReader(data))
+		status, _ := Refresh(request)
+		suite.Equal(http.StatusUnauthorized, status)
+	}
+}
+
+func (suite *LoginTestSuite) TestChangePassword() {
+	creds := auth.Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+	creds.Create()
+	tokens, _ := creds.Authorize()
+
+	request := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodPost, "/password", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+tokens.AuthToken)
+		rr := httptest.NewRecorder()
+		RunAuthenticated(ChangePassword, http.MethodPost)(rr, req)
+		return rr
+	}
+
+	suite.Equal(http.StatusBadRequest, request("invalid json").Code)
+	suite.Equal(http.StatusUnprocessableEntity, request(`{"password":"!wrongPwd","new_password":"!newStrongPwd"}`).Code)
+	suite.Equal(http.StatusOK, request(`{"password":"!strongPwd","new_password":"!newStrongPwd"}`).Code)
+
+	data, _ := json.Marshal(map[string]string{"renew_token": tokens.RenewToken})
+	req, _ := http.NewRequest(http.MethodPost, "/refresh", bytes.NewReader(data))
+	status, _ := Refresh(req)
+	suite.Equal(http.StatusUnauthorized, status)
+}
+
+func (suite *LoginTestSuite) TestChangeEmail() {
+	creds := auth.Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+	creds.Create()
+	tokens, _ := creds.Authorize()
+
+	request := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodPost, "/email", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+tokens.AuthToken)
+		rr := httptest.NewRecorder()
+		RunAuthenticated(ChangeEmail, http.MethodPost)(rr, req)
+		return rr
+	}
+
+	suite.Equal(http.StatusBadRequest, request("invalid json").Code)
+	suite.Equal(http.StatusUnprocessableEntity, request(`{"password":"!strongPwd","new_email":"not an email"}`).Code)
+	suite.Equal(http.StatusOK, request(`{"password":"!strongPwd","new_email":"jhon@testmail.com"}`).Code)
+
+	found, user := store.GetUserByEmail("jhon@testmail.com")
+	suite.True(found)
+	suite.Equal(suite.user.ID, user.ID)
+}
+
+func (suite *LoginTestSuite) TestLogoutAll_AfterEmailChange() {
+	creds := auth.Credentials{Email: "jhondoe@testmail.com", Password: "!strongPwd"}
+	creds.Create()
+	stale, _ := creds.Authorize()
+
+	change := auth.EmailChange{Password: "!strongPwd", NewEmail: "jhon@testmail.com"}
+	ok, _, _ := change.Apply(suite.user.ID)
+	suite.True(ok)
+
+	newcomer := store.User{Email: "jhondoe@testmail.com", Password: "!strongPwd"}
+	newcomer.Create()
+	creds = auth.Credentials{Email: "jhondoe@testmail.com", Password: "!strongPwd"}
+	creds.Create()
+	tokens, _ := creds.Authorize()
+
+	request, _ := http.NewRequest(http.MethodPost, "/logout-all", nil)
+	request.Header.Set("Authorization", "Bearer "+stale.AuthToken)
+	rr := httptest.NewRecorder()
+	RunAuthenticated(LogoutAll, http.MethodPost)(rr, request)
+	suite.Equal(http.StatusOK, rr.Code)
+
+	data, _ := json.Marshal(map[string]string{"renew_token": tokens.RenewToken})
+	request, _ = http.NewRequest(http.MethodPost, "/refresh", bytes.NewReader(data))
+	status, _ := Refresh(request)
+	suite.Equal(http.StatusOK, status)
+}
+
+func (suite *LoginTestSuite) TestSessions() {
+	data, _ := json.Marshal(auth.Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	})
+	request, _ := http.NewRequest(http.MethodPost, "/login", bytes.NewReader(data))
+	request.RemoteAddr = "192.0.2.1:1234"
+	request.Header.Set("User-Agent", "test-agent")
+	_, result := Login(request)
+	tokens := result.(*auth.Tokens)
+
+	list := func() []auth.SessionInfo {
+		req, _ := http.NewRequest(http.MethodGet, "/sessions", nil)
+		req.Header.Set("Authorization", "Bearer "+tokens.AuthToken)
+		rr := httptest.NewRecorder()
+		RunAuthenticated(Sessions, http.MethodGet)(rr, req)
+		suite.Equal(http.StatusOK, rr.Code)
+
+		var active []auth.SessionInfo
+		json.NewDecoder(rr.Body).Decode(&active)
+		return active
+	}
+
+	end := func(id string) int {
+		req, _ := http.NewRequest(http.MethodDelete, "/sessions/"+id, nil)
+		req.Header.Set("Authorization", "Bearer "+tokens.AuthToken)
+		rr := httptest.NewRecorder()
+		RunAuthenticated(EndSession, http.MethodDelete)(rr, req)
+		return rr.Code
+	}
+
+	active := list()
+	suite.Len(active, 1)
+	suite.Equal("192.0.2.1", active[0].IP)
+	suite.Equal("test-agent", active[0].UserAgent)
+
+	suite.Equal(http.StatusNotFound, end("unknown"))
+	suite.Equal(http.StatusNotFound, end(""))
+	suite.Equal(http.StatusOK, end(active[0].ID))
+	suite.Len(list(), 0)
+}
+
+func (suite *LoginTestSuite) TestLogin_WithSessionLimit() {
+	suite.sessions.Stop()
+	suite.sessions = session.NewManager(session.WithSessionLimit(1, session.RejectNewSession))
+	suite.sessions.Start(context.Background())
+	auth.UseSessions(suite.sessions)
+
+	data, _ := json.Marshal(auth.Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	})
+	request, _ := http.NewRequest(http.MethodPost, "/login", bytes.NewReader(data))
+	status, _ := Login(request)
+	suite.Equal(http.StatusOK, status)
+
+	request, _ = http.NewRequest(http.MethodPost, "/login", bytes.NewReader(data))
+	status, result := Login(request)
+	suite.Equal(http.StatusConflict, status)
+	suite.Equal(session.ErrSessionLimit.Error(), result.(map[string]string)["error"])
+}
@@ -1,10 +1,13 @@
 package auth
 
 import (
+	"context"
 	"errors"
 	"go-auth/src/session"
 	"go-auth/src/store"
+	"go-auth/src/verifier"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/asaskevich/govalidator"
@@ -12,59 +15,382 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-var jwtKey = []byte("jwt_secret_key")
-
 const authTokenLiveMinutes = 5
 const renewTokenLiveMinutes = 60 * 24
 
-//Credentials struct for credentials
+//Token type hints according RFC 7009
+const (
+	AccessTokenHint  = "access_token"
+	RefreshTokenHint = "refresh_token"
+)
+
+//ErrInvalidRenewToken returned when renew token is malformed, expired or unknown
+var ErrInvalidRenewToken = errors.New("Invalid or expired renew token")
+
+//ErrRenewTokenReused returned when already exchanged renew token is used again
+var ErrRenewTokenReused = errors.New("Renew token was already used. All tokens of the session are revoked")
+
+//ErrSessionNotFound returned when user has no active session with such id
+var ErrSessionNotFound = errors.New("Session not found")
+
+var keyring *Keyring
+
+var sessions *session.Manager
+
+var issuer = "go-auth"
+var audience = "go-auth"
+
+func init() {
+	key, err := GenerateSigningKey()
+	if err != nil {
+		panic(err)
+	}
+	keyring = NewKeyring(key)
+}
+
+//UseSessions sets started sessions manager which keeps renew tokens and IDs of revoked auth tokens
+func UseSessions(m *session.Manager) {
+	sessions = m
+}
+
+//UseKeyring sets keys which sign and verify tokens
+func UseKeyring(ring *Keyring) {
+	keyring = ring
+}
+
+//RotateSigningKey signs new tokens with key. Tokens signed by previous key remain valid
+func RotateSigningKey(key *SigningKey) {
+	keyring.Rotate(key)
+}
+
+//PublicKeys returns public keys for tokens verification
+func PublicKeys() JWKSet {
+	return keyring.PublicKeys()
+}
+
+//Keyfunc returns key for token signature verification
+func Keyfunc(token *jwt.Token) (interface{}, error) {
+	return keyring.Keyfunc(token)
+}
+
+//UseIssuer sets "iss" and "aud" claims of issued tokens
+func UseIssuer(iss string, aud string) {
+	issuer = iss
+	audience = aud
+}
+
+//Credentials struct for credentials. Login is email or nickname of the user, Email is accepted
+//for clients which log in by email only
 type Credentials struct {
-	Email     string `json:"email" valid:"required"`
+	Login     string `json:"login"`
+	Email     string `json:"email"`
 	Password  string `json:"password" valid:"required"`
+	IP        string `json:"-"`
+	UserAgent string `json:"-"`
 	isCreated bool
-	claim     Claim
+	user      *store.User
 }
 
-//Claim stuct contains auth user data
-type Claim struct {
-	Email      string
-	Nickname   string
-	FirstName  string
-	LastName   string
-	AuthToken  string
-	RenewToken string
+//Verify validates auth token and returns its claim
+func Verify(authToken string) (*AccessClaim, error) {
+	var claim AccessClaim
+	if err := parse(authToken, verifier.AccessToken, &claim); err != nil {
+		return nil, err
+	}
+	return &claim, nil
+}
+
+//NewContext returns context with verified claim
+func NewContext(ctx context.Context, claim *AccessClaim) context.Context {
+	return verifier.NewContext(ctx, claim)
+}
 
-	jwt.StandardClaims
+//FromContext returns verified claim from context
+func FromContext(ctx context.Context) (*AccessClaim, bool) {
+	return verifier.FromContext(ctx)
 }
 
-//Authorize authorize credentials and returns authorized user jwt token
-func (creds *Credentials) Authorize() (*Claim, error) {
+//Authorize authorize credentials and returns authorized user jwt tokens
+func (creds *Credentials) Authorize() (*Tokens, error) {
 	if !creds.isCreated {
 		return nil, errors.New("You need create credentilas first using method 'Create'")
 	}
 
-	stringifyToken := func(minutes int) (string, error) {
-		expiresAt := time.Now().Add(time.Duration(minutes) * time.Minute)
-		creds.claim.ExpiresAt = expiresAt.Unix()
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, creds.claim)
-		return token.SignedString(jwtKey)
+	tokens, s, err := issue(creds.user, func(expireAt int64) *session.Session {
+		s := sessions.Create(creds.user.ID, creds.user.Email, newTokenID(), expireAt)
+		s.SetClient(creds.IP, creds.UserAgent)
+		return s
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	var err error
-	creds.claim.AuthToken, err = stringifyToken(authTokenLiveMinutes)
+	evicted, err := sessions.Open(store.HashToken(tokens.RenewToken), s)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range evicted {
+		tokens.EvictedSessions = append(tokens.EvictedSessions, e.Family())
+	}
+	return tokens, nil
+}
+
+//Renew exchanges valid renew token for the new pair of tokens. Renew token can be
+//exchanged once, its second usage revokes all tokens of the family. Client at ip with userAgent
+//is checked against the one which logged in according session binding policy
+func Renew(renewToken string, ip string, userAgent string) (*Tokens, error) {
+	var claim RefreshClaim
+	if err := parse(renewToken, verifier.RefreshToken, &claim); err != nil {
+		return nil, ErrInvalidRenewToken
+	}
+
+	digest := store.HashToken(renewToken)
+	found, s := sessions.Get(digest)
+	if !found {
+		return nil, ErrInvalidRenewToken
+	}
+
+	retired, err := sessions.Retire(digest)
+	if err != nil {
+		return nil, err
+	}
+	if !retired {
+		log.Printf("Security event: reuse of renew token detected. Revoke family '%s' of user %s", s.Family(), s.Email())
+		if err := sessions.Revoke(s, session.RevokedOnTokenReuse); err != nil {
+			return nil, err
+		}
+		return nil, ErrRenewTokenReused
+	}
+
+	if err := sessions.Bind(s, ip, userAgent); err != nil {
+		return nil, err
+	}
+
+	found, user := store.GetUserByID(claim.Subject)
+	if !found {
+		//Tokens issued before users got IDs carry email as subject
+		found, user = store.GetUserByEmail(claim.Subject)
+	}
+	if !found {
+		return nil, ErrInvalidRenewToken
+	}
+
+	if s.UserID() != "" && s.UserID() != user.ID {
+		return nil, ErrInvalidRenewToken
+	}
+
+	tokens, next, err := issue(user, func(expireAt int64) *session.Session {
+		next := sessions.Rotate(s, expireAt)
+		next.SetUserID(user.ID)
+		return next
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	creds.claim.RenewToken, err = stringifyToken(renewTokenLiveMinutes)
+	if err := sessions.Add(store.HashToken(tokens.RenewToken), next); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+//Logout ends session which belongs to the renew token
+func Logout(renewToken string) error {
+	if err := parse(renewToken, verifier.RefreshToken, &RefreshClaim{}); err != nil {
+		return ErrInvalidRenewToken
+	}
+
+	return revokeRenewToken(store.HashToken(renewToken), session.RevokedByLogout)
+}
+
+//LogoutAll ends all sessions of the user with the ID
+func LogoutAll(userID string) error {
+	return sessions.RevokeUser(userID, session.RevokedByLogoutAll)
+}
+
+//SessionInfo describes active session of the user. ID is id of the renew tokens family
+type SessionInfo struct {
+	ID          string `json:"id"`
+	CreatedAt   int64  `json:"created_at"`
+	RefreshedAt int64  `json:"refreshed_at,omitempty"`
+	ExpireAt    int64  `json:"expire_at"`
+	IP          string `json:"ip"`
+	UserAgent   string `json:"user_agent"`
+}
+
+//ActiveSessions returns active sessions of the user with the ID, oldest first
+func ActiveSessions(userID string) ([]SessionInfo, error) {
+	active, err := sessions.UserSessions(userID)
 	if err != nil {
 		return nil, err
 	}
 
-	s := session.Create(creds.Email, creds.claim.ExpiresAt)
-	s.Add(creds.claim.RenewToken)
+	result := make([]SessionInfo, len(active))
+	for i, s := range active {
+		result[i] = SessionInfo{
+			ID:          s.Family(),
+			CreatedAt:   s.CreatedAt(),
+			RefreshedAt: s.RefreshedAt(),
+			ExpireAt:    s.ExpireAt(),
+			IP:          s.IP(),
+			UserAgent:   s.UserAgent(),
+		}
+	}
+	return result, nil
+}
+
+//EndSession revokes all renew tokens of the session with id of the user with userID
+func EndSession(userID string, id string) error {
+	active, err := sessions.UserSessions(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range active {
+		if s.Family() == id {
+			return sessions.Revoke(s, session.RevokedByUser)
+		}
+	}
+	return ErrSessionNotFound
+}
+
+//PasswordChange struct for password change of authenticated user
+type PasswordChange struct {
+	Password    string `json:"password" valid:"required"`
+	NewPassword string `json:"new_password" valid:"stringlength(6|64),required"`
+}
+
+//Apply checks current password of the user with the ID, replaces it with the new one and ends all sessions
+//of the user. Returns store.ErrUserNotFound if there is no such user
+func (change *PasswordChange) Apply(userID string) (bool, map[string]string, error) {
+	if valid, err := govalidator.ValidateStruct(change); !valid {
+		return false, govalidator.ErrorsByField(err), nil
+	}
+
+	if errors, err := checkPassword(userID, change.Password); errors != nil || err != nil {
+		return false, errors, err
+	}
+
+	if err := store.ChangePassword(userID, change.NewPassword); err != nil {
+		return true, nil, err
+	}
+	return true, nil, sessions.RevokeUser(userID, session.RevokedByPasswordChange)
+}
+
+//EmailChange struct for email change of authenticated user
+type EmailChange struct {
+	Password string `json:"password" valid:"required"`
+	NewEmail string `json:"new_email" valid:"email,required"`
+}
+
+//Apply checks password of the user with the ID, replaces email and ends all sessions of the user.
+//Account keeps its ID, so tokens issued after the change have the same subject.
+//Returns store.ErrUserNotFound if there is no such user
+func (change *EmailChange) Apply(userID string) (bool, map[string]string, error) {
+	change.NewEmail = store.CanonicalEmail(change.NewEmail)
+	if valid, err := govalidator.ValidateStruct(change); !valid {
+		return false, govalidator.ErrorsByField(err), nil
+	}
+
+	if errors, err := checkPassword(userID, change.Password); errors != nil || err != nil {
+		return false, errors, err
+	}
+
+	err := store.ChangeEmail(userID, change.NewEmail)
+	if err == store.ErrEmailTaken {
+		return false, map[string]string{"new_email": err.Error()}, nil
+	} else if err != nil {
+		return true, nil, err
+	}
+	return true, nil, sessions.RevokeUser(userID, session.RevokedByEmailChange)
+}
+
+//checkPassword finds user with the ID and checks its password. Returns validation errors if password is invalid
+//and store.ErrUserNotFound if there is no such user
+func checkPassword(userID string, password string) (map[string]string, error) {
+	found, user := store.GetUserByID(userID)
+	if !found {
+		return nil, store.ErrUserNotFound
+	}
+
+	creds := Credentials{Password: password}
+	if !creds.verifyPassword(user.HashedPwd) {
+		return map[string]string{"password": "Invalid password"}, nil
+	}
+	return nil, nil
+}
+
+//Revoke revokes auth or renew token. Hint is optional and may be "access_token" or "refresh_token".
+//Type of the token is read from its claims, so according RFC 7009 hint doesn't limit the search and unknown one is ignored.
+//Auth token is revoked in session store till its expiration, so replicas sharing the store reject it too
+func Revoke(token string, hint string) error {
+	var claim RefreshClaim
+	if err := parse(token, "", &claim); err != nil {
+		// According RFC 7009 invalid tokens do not cause an error response
+		return nil
+	}
+
+	if claim.Type == verifier.RefreshToken {
+		return revokeRenewToken(store.HashToken(token), session.RevokedByRequest)
+	}
+
+	return sessions.RevokeToken(claim.Id, claim.ExpiresAt)
+}
+
+//IsRevoked checks if auth token with the ID was revoked before its expiration. Token is treated as revoked
+//if session store can't be read
+func IsRevoked(id string) bool {
+	revoked, err := sessions.IsTokenRevoked(id)
+	if err != nil {
+		log.Println("Error while checking revoked token: ", err.Error())
+		return true
+	}
+	return revoked
+}
+
+func parse(tokenString string, tokenType string, claim verifier.TypedClaims) error {
+	v := verifier.Verifier{
+		Keys:      keyring,
+		TokenType: tokenType,
+		Issuer:    issuer,
+		Audience:  audience,
+		IsRevoked: IsRevoked,
+	}
+	return v.Verify(tokenString, claim)
+}
+
+//revokeRenewToken revokes all tokens of the renew token family
+func revokeRenewToken(digest string, reason string) error {
+	found, s := sessions.Get(digest)
+	if !found {
+		return sessions.Delete(digest)
+	}
+	return sessions.Revoke(s, reason)
+}
+
+//issue issues new pair of tokens. Session of renew token is made by next from its expiration time,
+//renew token expires with the session. Callers store the session
+func issue(user *store.User, next func(expireAt int64) *session.Session) (*Tokens, *session.Session, error) {
+	now := time.Now()
+	access := newAccessClaim(user, now)
+	refresh := newRefreshClaim(user, now)
+	s := next(refresh.ExpiresAt)
+	refresh.ExpiresAt = s.ExpireAt()
+
+	var tokens Tokens
+	var err error
+	tokens.AuthToken, err = keyring.sign(access)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	return &creds.claim, nil
+	tokens.RenewToken, err = keyring.sign(refresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	tokens.ExpiresIn = access.ExpiresAt - now.Unix()
+
+	return &tokens, s, nil
 }
 
 func (creds *Credentials) verifyPassword(hashedPwd string) bool {
@@ -76,16 +402,29 @@ func (creds *Credentials) verifyPassword(hashedPwd string) bool {
 	return true
 }
 
-//Create create auth data according provided credentials
+//Create create auth data according provided credentials. User is looked up by canonical form of email
+//or by nickname in any case
 func (creds *Credentials) Create() (bool, map[string]string) {
+	field, login := "login", strings.TrimSpace(creds.Login)
+	if login == "" && creds.Email != "" {
+		field, login = "email", strings.TrimSpace(creds.Email)
+	}
+
+	validationErrors := make(map[string]string)
 	if valid, err := govalidator.ValidateStruct(creds); !valid {
-		return false, govalidator.ErrorsByField(err)
+		validationErrors = govalidator.ErrorsByField(err)
+	}
+	if login == "" {
+		validationErrors[field] = "Email or nickname is required"
+	}
+	if len(validationErrors) > 0 {
+		return false, validationErrors
 	}
 
-	found, user := store.GetUserByEmail(creds.Email)
+	found, user := store.GetUserByLogin(login)
 	if !found {
 		return false, map[string]string{
-			"email": "Can't found user with such email",
+			field: "Can't found user with such email or nickname",
 		}
 	}
 
@@ -95,11 +434,7 @@ func (creds *Credentials) Create() (bool, map[string]string) {
 		}
 	}
 
-	creds.claim.Email = user.Email
-	creds.claim.Nickname = user.Nickname
-	creds.claim.FirstName = user.FirstName
-	creds.claim.LastName = user.LastName
-
+	creds.user = user
 	creds.isCreated = true
 	return true, nil
 }
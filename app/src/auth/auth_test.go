@@ -1,10 +1,27 @@
 package auth
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"go-auth/src/session"
 	"go-auth/src/store"
+	"go-auth/src/verifier"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -23,6 +40,9 @@ func (suite *AuthTestSuite) SetupSuite() {
 func (suite *AuthTestSuite) SetupTest() {
 	store.CreateDefaultBacket()
 
+	UseSessions(session.NewManager())
+	sessions.Start(context.Background())
+
 	suite.user = &store.User{
 		Email:     "jhondoe@testmail.com",
 		Password:  "!strongPwd",
@@ -38,6 +58,7 @@ func (suite *AuthTestSuite) TearDownSuite() {
 }
 
 func (suite *AuthTestSuite) TearDownTest() {
+	sessions.Stop()
 	store.DropDatabase()
 }
 
@@ -55,6 +76,21 @@ func (suite *AuthTestSuite) TestCreateAuth_WithValidData() {
 	suite.True(ok)
 }
 
+func (suite *AuthTestSuite) TestCreateAuth_WithEmailInAnotherCase() {
+	creds := Credentials{
+		Email:    " JhonDoe@TestMail.com ",
+		Password: "!strongPwd",
+	}
+
+	ok, _ := creds.Create()
+	suite.True(ok)
+
+	tokens, _ := creds.Authorize()
+	claim, _ := Verify(tokens.AuthToken)
+	suite.Equal(suite.user.ID, claim.Subject)
+	suite.Equal("jhondoe@testmail.com", claim.Email)
+}
+
 func (suite *AuthTestSuite) TestCreateAuth_WithInvalidEmail() {
 	creds := Credentials{
 		Email:    "not-jhondoe@testmail.com",
@@ -71,10 +107,26 @@ func (suite *AuthTestSuite) TestCreateAuth_WithInvalidCredentials() {
 
 	ok, errors := creds.Create()
 	suite.False(ok)
-	suite.Contains(errors, "email")
+	suite.Contains(errors, "login")
 	suite.Contains(errors, "password")
 }
 
+func (suite *AuthTestSuite) TestCreateAuth_WithNickname() {
+	creds := Credentials{Login: "jD", Password: "!strongPwd"}
+	ok, _ := creds.Create()
+	suite.True(ok)
+	suite.Equal(suite.user.ID, creds.user.ID)
+
+	creds = Credentials{Login: "jhondoe@testmail.com", Password: "!strongPwd"}
+	ok, _ = creds.Create()
+	suite.True(ok)
+
+	creds = Credentials{Login: "unknown", Password: "!strongPwd"}
+	ok, errors := creds.Create()
+	suite.False(ok)
+	suite.Contains(errors, "login")
+}
+
 func (suite *AuthTestSuite) TestCreateAuth_WithInvalidPassword() {
 	creds := Credentials{
 		Email:    "jhondoe@testmail.com",
@@ -96,9 +148,9 @@ func (suite *AuthTestSuite) TestAuthorize_WithValidData() {
 
 	tokens, _ := creds.Authorize()
 
-	claim := &Claim{}
+	claim := &AccessClaim{}
 	tknAuth, _ := jwt.ParseWithClaims(tokens.AuthToken, claim, func(token *jwt.Token) (interface{}, error) {
-		return []byte("jwt_secret_key"), nil
+		return Keyfunc(token)
 	})
 	suite.True(tknAuth.Valid)
 
@@ -130,7 +182,7 @@ func (suite *AuthTestSuite) TestAuthorize_WithSecondAuthorize() {
 
 	suite.Nil(err)
 
-	claim := &Claim{}
+	claim := &AccessClaim{}
 
 	newCreds := Credentials{
 		Email:    "jhondoe@testmail.com",
@@ -142,10 +194,648 @@ func (suite *AuthTestSuite) TestAuthorize_WithSecondAuthorize() {
 	suite.Nil(err)
 
 	tknAuth, _ := jwt.ParseWithClaims(tokens.AuthToken, claim, func(token *jwt.Token) (interface{}, error) {
-		return []byte("jwt_secret_key"), nil
+		return Keyfunc(token)
 	})
 	suite.True(tknAuth.Valid)
 
 	suite.Equal(creds.Email, claim.Email)
-	suite.Equal(oldTokens, tokens)
+	suite.NotEqual(oldTokens.AuthToken, tokens.AuthToken)
+	suite.NotEqual(oldTokens.RenewToken, tokens.RenewToken)
+}
+
+func (suite *AuthTestSuite) TestRenew_WithValidToken() {
+	creds := Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+
+	creds.Create()
+	tokens, err := creds.Authorize()
+	suite.Nil(err)
+
+	renewed, err := Renew(tokens.RenewToken, "", "")
+	suite.Nil(err)
+	suite.NotEmpty(renewed.AuthToken)
+	suite.NotEmpty(renewed.RenewToken)
+
+	claim, err := Verify(renewed.AuthToken)
+	suite.Nil(err)
+	suite.Equal(creds.Email, claim.Email)
+	suite.Equal(suite.user.Nickname, claim.Nickname)
+
+	_, err = Renew(renewed.RenewToken, "", "")
+	suite.Nil(err)
+}
+
+func (suite *AuthTestSuite) TestRenew_WithAuthToken() {
+	creds := Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+
+	creds.Create()
+	tokens, _ := creds.Authorize()
+
+	_, err := Renew(tokens.AuthToken, "", "")
+	suite.Equal(ErrInvalidRenewToken, err)
+}
+
+func (suite *AuthTestSuite) TestRenew_WithInvalidToken() {
+	_, err := Renew("invalid.renew.token", "", "")
+	suite.Equal(ErrInvalidRenewToken, err)
+
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, RefreshClaim{Type: verifier.RefreshToken})
+	tkn, _ := forged.SignedString([]byte("not_a_jwt_secret_key"))
+
+	_, err = Renew(tkn, "", "")
+	suite.Equal(ErrInvalidRenewToken, err)
+}
+
+func (suite *AuthTestSuite) TestLogout() {
+	creds := Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+
+	creds.Create()
+	tokens, _ := creds.Authorize()
+
+	suite.Nil(Logout(tokens.RenewToken))
+
+	found, _ := store.GetRenewToken(store.HashToken(tokens.RenewToken))
+	suite.False(found)
+
+	_, err := Renew(tokens.RenewToken, "", "")
+	suite.Equal(ErrInvalidRenewToken, err)
+
+	suite.Equal(ErrInvalidRenewToken, Logout("invalid.renew.token"))
+}
+
+func (suite *AuthTestSuite) TestRevoke() {
+	creds := Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+
+	creds.Create()
+	tokens, _ := creds.Authorize()
+
+	suite.Nil(Revoke(tokens.AuthToken, AccessTokenHint))
+	_, err := Verify(tokens.AuthToken)
+	suite.Equal(verifier.ErrRevokedToken, err)
+	var access, refresh RefreshClaim
+	parse(tokens.AuthToken, "", &access)
+	parse(tokens.RenewToken, "", &refresh)
+	suite.True(IsRevoked(access.Id))
+	suite.False(IsRevoked(refresh.Id))
+
+	revoked, _ := store.IsTokenRevoked(access.Id)
+	suite.True(revoked, "revoked token is kept in persistent store")
+	store.ClearRevokedTokens(access.ExpiresAt)
+	suite.True(IsRevoked(access.Id))
+	store.ClearRevokedTokens(access.ExpiresAt + 1)
+	suite.False(IsRevoked(access.Id))
+
+	suite.Nil(Revoke(tokens.RenewToken, ""))
+	_, err = Renew(tokens.RenewToken, "", "")
+	suite.Equal(ErrInvalidRenewToken, err)
+
+	suite.Nil(Revoke("invalid.token", ""))
+}
+
+func (suite *AuthTestSuite) TestRevoke_IgnoresUnknownHint() {
+	creds := Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+
+	creds.Create()
+	tokens, _ := creds.Authorize()
+
+	suite.Nil(Revoke(tokens.AuthToken, "id_token"))
+	_, err := Verify(tokens.AuthToken)
+	suite.Equal(verifier.ErrRevokedToken, err)
+
+	suite.Nil(Revoke(tokens.RenewToken, AccessTokenHint), "hint doesn't limit the search")
+	_, err = Renew(tokens.RenewToken, "", "")
+	suite.Equal(ErrInvalidRenewToken, err)
+}
+
+func TestParseSigningKey(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	ecDer, _ := x509.MarshalECPrivateKey(ecKey)
+	edDer, _ := x509.MarshalPKCS8PrivateKey(edKey)
+
+	cases := []struct {
+		block *pem.Block
+		alg   string
+		kty   string
+	}{
+		{&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}, "RS256", "RSA"},
+		{&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDer}, "ES256", "EC"},
+		{&pem.Block{Type: "PRIVATE KEY", Bytes: edDer}, "EdDSA", "OKP"},
+	}
+
+	for _, c := range cases {
+		key, err := ParseSigningKey(pem.EncodeToMemory(c.block))
+		if !assert.Nil(t, err) {
+			continue
+		}
+		assert.Equal(t, c.alg, key.Method.Alg())
+		assert.Equal(t, c.kty, key.JWK().Kty)
+		assert.Equal(t, key.ID, key.JWK().Kid)
+
+		signed, err := key.sign(AccessClaim{Email: "jhondoe@testmail.com"})
+		assert.Nil(t, err)
+
+		claim := &AccessClaim{}
+		tkn, err := jwt.ParseWithClaims(signed, claim, func(token *jwt.Token) (interface{}, error) {
+			return key.Public(), nil
+		})
+		assert.Nil(t, err)
+		assert.True(t, tkn.Valid)
+		assert.Equal(t, "jhondoe@testmail.com", claim.Email)
+	}
+
+	_, err := ParseSigningKey([]byte("not a pem"))
+	assert.NotNil(t, err)
+}
+
+func TestLoadOrCreateSigningKey(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "keys")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "signing.pem")
+
+	created, isNew, err := LoadOrCreateSigningKey(path)
+	assert.Nil(t, err)
+	assert.True(t, isNew)
+	assert.Equal(t, "ES256", created.Method.Alg())
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	loaded, isNew, err := LoadOrCreateSigningKey(path)
+	assert.Nil(t, err)
+	assert.False(t, isNew)
+	assert.Equal(t, created.ID, loaded.ID)
+
+	ioutil.WriteFile(path, []byte("not a pem"), 0600)
+	_, _, err = LoadOrCreateSigningKey(path)
+	assert.NotNil(t, err)
+}
+
+func TestPublicKeys(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	key, _ := NewSigningKey(edKey)
+
+	previous := keyring
+	UseKeyring(NewKeyring(key))
+	defer UseKeyring(previous)
+
+	jwks := PublicKeys()
+	assert.Len(t, jwks.Keys, 1)
+	assert.Equal(t, "EdDSA", jwks.Keys[0].Alg)
+	assert.Equal(t, "Ed25519", jwks.Keys[0].Crv)
+	assert.Equal(t, key.ID, jwks.Keys[0].Kid)
+}
+
+func TestKeyring_Rotate(t *testing.T) {
+	oldKey, _ := GenerateSigningKey()
+	newKey, _ := GenerateSigningKey()
+
+	now := time.Now()
+	ring := NewKeyring(oldKey)
+	ring.now = func() time.Time { return now }
+
+	oldToken, _ := ring.sign(AccessClaim{Email: "jhondoe@testmail.com"})
+
+	ring.Rotate(newKey)
+	newToken, _ := ring.sign(AccessClaim{Email: "jhondoe@testmail.com"})
+
+	assert.Equal(t, newKey.ID, ring.Active().ID)
+	assert.Len(t, ring.PublicKeys().Keys, 2)
+
+	tkn, err := jwt.ParseWithClaims(newToken, &AccessClaim{}, ring.Keyfunc)
+	assert.Nil(t, err)
+	assert.Equal(t, newKey.ID, tkn.Header["kid"])
+
+	tkn, err = jwt.ParseWithClaims(oldToken, &AccessClaim{}, ring.Keyfunc)
+	assert.Nil(t, err)
+	assert.Equal(t, oldKey.ID, tkn.Header["kid"])
+
+	now = now.Add(renewTokenLiveMinutes*time.Minute + time.Second)
+
+	_, err = jwt.ParseWithClaims(oldToken, &AccessClaim{}, ring.Keyfunc)
+	assert.NotNil(t, err)
+	assert.Len(t, ring.PublicKeys().Keys, 1)
+
+	_, err = jwt.ParseWithClaims(newToken, &AccessClaim{}, ring.Keyfunc)
+	assert.Nil(t, err)
+}
+
+func (suite *AuthTestSuite) TestVerify() {
+	creds := Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+
+	creds.Create()
+	tokens, _ := creds.Authorize()
+
+	claim, err := Verify(tokens.AuthToken)
+	suite.Nil(err)
+	suite.Equal(creds.Email, claim.Email)
+	suite.Equal(verifier.AccessToken, claim.TokenType())
+
+	_, err = Verify(tokens.RenewToken)
+	suite.Equal(verifier.ErrWrongTokenType, err)
+
+	Revoke(tokens.AuthToken, AccessTokenHint)
+	_, err = Verify(tokens.AuthToken)
+	suite.Equal(verifier.ErrRevokedToken, err)
+}
+
+func (suite *AuthTestSuite) TestAuthorize_StandardClaims() {
+	creds := Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+
+	creds.Create()
+	tokens, _ := creds.Authorize()
+
+	access, err := Verify(tokens.AuthToken)
+	suite.Nil(err)
+	suite.Equal(suite.user.ID, access.Subject)
+	suite.NotEmpty(access.Subject)
+	suite.Equal("go-auth", access.Issuer)
+	suite.Equal("go-auth", access.Audience)
+	suite.NotEmpty(access.Id)
+	suite.NotZero(access.IssuedAt)
+	suite.Equal(access.IssuedAt, access.NotBefore)
+	suite.Equal(int64(authTokenLiveMinutes*60), tokens.ExpiresIn)
+
+	refresh := &RefreshClaim{}
+	suite.Nil(parse(tokens.RenewToken, verifier.RefreshToken, refresh))
+	suite.Equal(suite.user.ID, refresh.Subject)
+	suite.NotEqual(access.Id, refresh.Id)
+
+	suite.Equal(verifier.ErrWrongTokenType, parse(tokens.AuthToken, verifier.RefreshToken, &RefreshClaim{}))
+
+	UseIssuer("another-issuer", "go-auth")
+	defer UseIssuer("go-auth", "go-auth")
+	_, err = Verify(tokens.AuthToken)
+	suite.Equal(verifier.ErrInvalidToken, err)
+}
+
+func (suite *AuthTestSuite) TestRenew_WithReusedToken() {
+	creds := Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+
+	creds.Create()
+	tokens, _ := creds.Authorize()
+
+	renewed, err := Renew(tokens.RenewToken, "", "")
+	suite.Nil(err)
+
+	_, err = Renew(tokens.RenewToken, "", "")
+	suite.Equal(ErrRenewTokenReused, err)
+
+	_, err = Renew(renewed.RenewToken, "", "")
+	suite.Equal(ErrInvalidRenewToken, err)
+
+	found, _ := store.GetRenewToken(store.HashToken(renewed.RenewToken))
+	suite.False(found)
+}
+
+func (suite *AuthTestSuite) TestRenew_KeepsFamily() {
+	creds := Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+
+	creds.Create()
+	tokens, _ := creds.Authorize()
+	another, _ := creds.Authorize()
+
+	renewed, _ := Renew(tokens.RenewToken, "", "")
+
+	_, first := sessions.Get(store.HashToken(tokens.RenewToken))
+	_, second := sessions.Get(store.HashToken(renewed.RenewToken))
+	_, third := sessions.Get(store.HashToken(another.RenewToken))
+
+	suite.True(first.Retired())
+	suite.False(second.Retired())
+	suite.Equal(first.Family(), second.Family())
+	suite.NotEqual(first.Family(), third.Family())
+
+	suite.Nil(Logout(renewed.RenewToken))
+
+	_, err := Renew(another.RenewToken, "", "")
+	suite.Nil(err)
+}
+
+func (suite *AuthTestSuite) TestAuthorize_StoresTokenDigest() {
+	creds := Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+
+	creds.Create()
+	tokens, _ := creds.Authorize()
+
+	found, _ := sessions.Get(tokens.RenewToken)
+	suite.False(found)
+
+	found, _ = sessions.Get(store.HashToken(tokens.RenewToken))
+	suite.True(found)
+}
+
+func (suite *AuthTestSuite) TestLogoutAll() {
+	creds := Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+
+	creds.Create()
+	first, _ := creds.Authorize()
+	second, _ := creds.Authorize()
+	renewed, _ := Renew(second.RenewToken, "", "")
+
+	suite.Nil(LogoutAll(suite.user.ID))
+
+	for _, token := range []string{first.RenewToken, renewed.RenewToken} {
+		_, err := Renew(token, "", "")
+		suite.Equal(ErrInvalidRenewToken, err)
+	}
+	suite.Len(store.GetUserRenewTokens(suite.user.ID), 0)
+}
+
+func (suite *AuthTestSuite) TestEmailChange() {
+	another := store.User{Email: "another@testmail.com", Password: "!strongPwd"}
+	another.Create()
+
+	creds := Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+	creds.Create()
+	tokens, _ := creds.Authorize()
+
+	change := EmailChange{Password: "!wrongPwd", NewEmail: "jhon@testmail.com"}
+	ok, errors, _ := change.Apply(suite.user.ID)
+	suite.False(ok)
+	suite.Contains(errors, "password")
+
+	change = EmailChange{Password: "!strongPwd", NewEmail: "Another@TestMail.com"}
+	ok, errors, _ = change.Apply(suite.user.ID)
+	suite.False(ok)
+	suite.Contains(errors, "new_email")
+
+	change = EmailChange{Password: "!strongPwd", NewEmail: "jhon@testmail.com"}
+	ok, _, err := change.Apply(suite.user.ID)
+	suite.True(ok)
+	suite.Nil(err)
+
+	_, err = Renew(tokens.RenewToken, "", "")
+	suite.Equal(ErrInvalidRenewToken, err)
+
+	valid, _ := creds.Create()
+	suite.False(valid)
+	creds = Credentials{Email: "jhon@testmail.com", Password: "!strongPwd"}
+	valid, _ = creds.Create()
+	suite.True(valid)
+
+	tokens, _ = creds.Authorize()
+	claim, _ := Verify(tokens.AuthToken)
+	suite.Equal(suite.user.ID, claim.Subject)
+	suite.Equal("jhon@testmail.com", claim.Email)
+}
+
+func (suite *AuthTestSuite) TestRenew_WithEmailSubject() {
+	claim := newRefreshClaim(suite.user, time.Now())
+	claim.Subject = suite.user.Email
+	token, _ := keyring.sign(claim)
+	sessions.Add(store.HashToken(token), sessions.Create("", suite.user.Email, "family", claim.ExpiresAt))
+
+	tokens, err := Renew(token, "", "")
+	suite.Nil(err)
+	suite.Nil(parse(tokens.RenewToken, verifier.RefreshToken, claim))
+	suite.Equal(suite.user.ID, claim.Subject)
+
+	active, _ := ActiveSessions(suite.user.ID)
+	suite.Len(active, 1)
+}
+
+func (suite *AuthTestSuite) TestPasswordChange() {
+	creds := Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+	creds.Create()
+	tokens, _ := creds.Authorize()
+
+	change := PasswordChange{Password: "!wrongPwd", NewPassword: "!newStrongPwd"}
+	ok, errors, _ := change.Apply(suite.user.ID)
+	suite.False(ok)
+	suite.Contains(errors, "password")
+
+	change = PasswordChange{Password: "!strongPwd", NewPassword: "short"}
+	ok, errors, _ = change.Apply(suite.user.ID)
+	suite.False(ok)
+	suite.Contains(errors, "new_password")
+
+	change = PasswordChange{Password: "!strongPwd", NewPassword: "!newStrongPwd"}
+	ok, _, err := change.Apply(suite.user.ID)
+	suite.True(ok)
+	suite.Nil(err)
+
+	_, err = Renew(tokens.RenewToken, "", "")
+	suite.Equal(ErrInvalidRenewToken, err)
+
+	valid, _ := creds.Create()
+	suite.False(valid)
+	creds.Password = "!newStrongPwd"
+	valid, _ = creds.Create()
+	suite.True(valid)
+}
+
+func (suite *AuthTestSuite) TestActiveSessions() {
+	creds := Credentials{
+		Email:     "jhondoe@testmail.com",
+		Password:  "!strongPwd",
+		IP:        "127.0.0.1",
+		UserAgent: "test-agent",
+	}
+
+	creds.Create()
+	first, _ := creds.Authorize()
+	creds.IP = "127.0.0.2"
+	second, _ := creds.Authorize()
+	Renew(second.RenewToken, "", "")
+
+	active, err := ActiveSessions(suite.user.ID)
+	suite.Nil(err)
+	suite.Len(active, 2)
+
+	ips := []string{active[0].IP, active[1].IP}
+	suite.ElementsMatch([]string{"127.0.0.1", "127.0.0.2"}, ips)
+	for _, info := range active {
+		suite.Equal("test-agent", info.UserAgent)
+		suite.NotZero(info.CreatedAt)
+		if info.IP == "127.0.0.2" {
+			suite.NotZero(info.RefreshedAt)
+		} else {
+			suite.Zero(info.RefreshedAt)
+		}
+	}
+
+	suite.Equal(ErrSessionNotFound, EndSession(suite.user.ID, "unknown"))
+	suite.Equal(ErrSessionNotFound, EndSession("another_user", active[0].ID))
+
+	for _, info := range active {
+		if info.IP == "127.0.0.1" {
+			suite.Nil(EndSession(suite.user.ID, info.ID))
+		}
+	}
+	_, err = Renew(first.RenewToken, "", "")
+	suite.Equal(ErrInvalidRenewToken, err)
+
+	active, _ = ActiveSessions(suite.user.ID)
+	suite.Len(active, 1)
+}
+
+func (suite *AuthTestSuite) TestAuthorize_WithSessionLimit() {
+	sessions.Stop()
+	UseSessions(session.NewManager(session.WithSessionLimit(1, session.EvictOldestSession)))
+	sessions.Start(context.Background())
+
+	creds := Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+	creds.Create()
+
+	first, _ := creds.Authorize()
+	suite.Empty(first.EvictedSessions)
+	active, _ := ActiveSessions(suite.user.ID)
+
+	second, err := creds.Authorize()
+	suite.Nil(err)
+	suite.Equal([]string{active[0].ID}, second.EvictedSessions)
+
+	_, err = Renew(first.RenewToken, "", "")
+	suite.Equal(ErrInvalidRenewToken, err)
+	_, err = Renew(second.RenewToken, "", "")
+	suite.Nil(err)
+}
+
+func (suite *AuthTestSuite) TestAuthorize_WithIdleTimeout() {
+	sessions.Stop()
+	UseSessions(session.NewManager(session.WithIdleTimeout(time.Hour)))
+	sessions.Start(context.Background())
+
+	creds := Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+	creds.Create()
+
+	tokens, _ := creds.Authorize()
+	var claim RefreshClaim
+	suite.Nil(parse(tokens.RenewToken, verifier.RefreshToken, &claim))
+	suite.InDelta(time.Now().Add(time.Hour).Unix(), claim.ExpiresAt, 1)
+
+	tokens, err := Renew(tokens.RenewToken, "", "")
+	suite.Nil(err)
+	suite.Nil(parse(tokens.RenewToken, verifier.RefreshToken, &claim))
+	suite.InDelta(time.Now().Add(time.Hour).Unix(), claim.ExpiresAt, 1)
+}
+
+func (suite *AuthTestSuite) TestRenew_FromAnotherClient() {
+	sessions.Stop()
+	UseSessions(session.NewManager(session.WithBindingPolicy(session.ReauthClientMismatch)))
+	sessions.Start(context.Background())
+
+	creds := Credentials{
+		Email:     "jhondoe@testmail.com",
+		Password:  "!strongPwd",
+		IP:        "192.168.1.17",
+		UserAgent: "curl/7.68.0",
+	}
+	creds.Create()
+	tokens, _ := creds.Authorize()
+
+	tokens, err := Renew(tokens.RenewToken, "192.168.1.18", "curl/7.72.0")
+	suite.Nil(err)
+
+	_, err = Renew(tokens.RenewToken, "10.0.0.1", "curl/7.68.0")
+	suite.Equal(session.ErrClientMismatch, err)
+	active, _ := ActiveSessions(suite.user.ID)
+	suite.Empty(active)
+}
+
+func (suite *AuthTestSuite) TestRenew_WithReusedToken_EmitsRevokedEvent() {
+	revoked := make(chan session.Event, 1)
+	sessions.Subscribe(func(e session.Event) {
+		if e.Type == session.SessionRevoked {
+			revoked <- e
+		}
+	})
+
+	creds := Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+	creds.Create()
+	tokens, _ := creds.Authorize()
+
+	Renew(tokens.RenewToken, "", "")
+	Renew(tokens.RenewToken, "", "")
+
+	e := <-revoked
+	suite.Equal(suite.user.ID, e.UserID)
+	suite.Equal("jhondoe@testmail.com", e.Email)
+	suite.Equal(session.RevokedOnTokenReuse, e.Reason)
+}
+
+//failingStore fails writes of renew tokens once failing is set
+type failingStore struct {
+	session.BoltStore
+	failing int32
+}
+
+func (s *failingStore) AddRenewTokens(tokens []store.RenewToken) error {
+	if atomic.LoadInt32(&s.failing) == 1 {
+		return errors.New("disk is full")
+	}
+	return s.BoltStore.AddRenewTokens(tokens)
+}
+
+func (suite *AuthTestSuite) TestAuthorize_WithWriteFailure() {
+	persistent := &failingStore{}
+	sessions.Stop()
+	UseSessions(session.NewManager(session.WithStore(persistent)))
+	sessions.Start(context.Background())
+
+	creds := Credentials{
+		Email:    "jhondoe@testmail.com",
+		Password: "!strongPwd",
+	}
+	creds.Create()
+	tokens, err := creds.Authorize()
+	suite.Nil(err)
+
+	atomic.StoreInt32(&persistent.failing, 1)
+	renewed, err := Renew(tokens.RenewToken, "", "")
+	suite.NotNil(err)
+	suite.Nil(renewed)
+	authorized, err := creds.Authorize()
+	suite.NotNil(err)
+	suite.Nil(authorized)
 }
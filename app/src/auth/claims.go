@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"go-auth/src/store"
+	"go-auth/src/verifier"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+//AccessClaim is a payload of auth token. It contains user data for services which verify the token
+//and is defined by verifier package, so they decode the same claim the service issues
+type AccessClaim = verifier.Claims
+
+//RefreshClaim is a payload of renew token. It identifies user only
+type RefreshClaim struct {
+	Type string `json:"typ"`
+
+	jwt.StandardClaims
+}
+
+//Tokens is a pair of issued tokens. EvictedSessions lists ids of sessions ended
+//to keep active sessions of the user within the limit
+type Tokens struct {
+	AuthToken       string
+	RenewToken      string
+	ExpiresIn       int64
+	EvictedSessions []string `json:"EvictedSessions,omitempty"`
+}
+
+//TokenType returns type of token which carries the claim
+func (claim *RefreshClaim) TokenType() string {
+	return claim.Type
+}
+
+//TokenID returns unique ID of token which carries the claim
+func (claim *RefreshClaim) TokenID() string {
+	return claim.Id
+}
+
+func newAccessClaim(user *store.User, now time.Time) *AccessClaim {
+	return &AccessClaim{
+		Email:          user.Email,
+		Nickname:       user.Nickname,
+		FirstName:      user.FirstName,
+		LastName:       user.LastName,
+		Type:           verifier.AccessToken,
+		StandardClaims: standardClaims(user.ID, now, authTokenLiveMinutes),
+	}
+}
+
+func newRefreshClaim(user *store.User, now time.Time) *RefreshClaim {
+	return &RefreshClaim{
+		Type:           verifier.RefreshToken,
+		StandardClaims: standardClaims(user.ID, now, renewTokenLiveMinutes),
+	}
+}
+
+func standardClaims(subject string, now time.Time, minutes int) jwt.StandardClaims {
+	return jwt.StandardClaims{
+		Subject:   subject,
+		Issuer:    issuer,
+		Audience:  audience,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		ExpiresAt: now.Add(time.Duration(minutes) * time.Minute).Unix(),
+		Id:        newTokenID(),
+	}
+}
+
+func newTokenID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(id)
+}
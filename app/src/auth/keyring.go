@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+//Keyring holds active signing key and previous keys which are still valid for verification
+type Keyring struct {
+	mutex    sync.RWMutex
+	active   *SigningKey
+	previous []retiringKey
+	now      func() time.Time
+}
+
+type retiringKey struct {
+	key      *SigningKey
+	retireAt time.Time
+}
+
+//NewKeyring creates keyring with active key. Previous keys are kept until all tokens signed by them expire
+func NewKeyring(active *SigningKey, previous ...*SigningKey) *Keyring {
+	ring := &Keyring{
+		active: active,
+		now:    time.Now,
+	}
+	for _, key := range previous {
+		ring.retire(key)
+	}
+	return ring
+}
+
+//Rotate makes key active. Previous active key stays valid for verification
+func (ring *Keyring) Rotate(key *SigningKey) {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+
+	if ring.active.ID == key.ID {
+		return
+	}
+	ring.retire(ring.active)
+	ring.active = key
+}
+
+//Active returns key which signs new tokens
+func (ring *Keyring) Active() *SigningKey {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+
+	return ring.active
+}
+
+//Key finds not retired key by its id
+func (ring *Keyring) Key(kid string) (*SigningKey, bool) {
+	for _, key := range ring.keys() {
+		if key.ID == kid {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+//PublicKeys returns all not retired public keys
+func (ring *Keyring) PublicKeys() JWKSet {
+	keys := ring.keys()
+	jwks := JWKSet{Keys: make([]JWK, 0, len(keys))}
+	for _, key := range keys {
+		jwks.Keys = append(jwks.Keys, key.JWK())
+	}
+	return jwks
+}
+
+//Keyfunc returns key for token signature verification according "kid" header
+func (ring *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	key := ring.Active()
+	if kid, ok := token.Header["kid"].(string); ok {
+		if key, ok = ring.Key(kid); !ok {
+			return nil, fmt.Errorf("Unknown signing key: %s", kid)
+		}
+	}
+
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("Unexpected signing method: %s", token.Method.Alg())
+	}
+	return key.Public(), nil
+}
+
+func (ring *Keyring) sign(claims jwt.Claims) (string, error) {
+	return ring.Active().sign(claims)
+}
+
+//keys returns active key first and drops previous keys which are retired
+func (ring *Keyring) keys() []*SigningKey {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+
+	now := ring.now()
+	keys := []*SigningKey{ring.active}
+	previous := ring.previous[:0]
+	for _, k := range ring.previous {
+		if now.Before(k.retireAt) {
+			previous = append(previous, k)
+			keys = append(keys, k.key)
+		}
+	}
+	ring.previous = previous
+	return keys
+}
+
+func (ring *Keyring) retire(key *SigningKey) {
+	ring.previous = append(ring.previous, retiringKey{
+		key:      key,
+		retireAt: ring.now().Add(renewTokenLiveMinutes * time.Minute),
+	})
+}
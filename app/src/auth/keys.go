@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"go-auth/src/verifier"
+	"io/ioutil"
+	"math/big"
+	"os"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+//SigningKey is a private key used for tokens signing
+type SigningKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	private crypto.Signer
+}
+
+//JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+//JWKSet is a set of public keys published for tokens verification
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+//LoadSigningKey reads PEM encoded private key from file
+func LoadSigningKey(path string) (*SigningKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSigningKey(data)
+}
+
+//LoadOrCreateSigningKey reads PEM encoded private key from file. If there is no such file,
+//ES256 key is generated and saved there, so tokens stay valid after restart
+func LoadOrCreateSigningKey(path string) (*SigningKey, bool, error) {
+	key, err := LoadSigningKey(path)
+	if !os.IsNotExist(err) {
+		return key, false, err
+	}
+
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, false, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, false, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, false, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return nil, false, err
+	}
+
+	key, err = NewSigningKey(private)
+	return key, true, err
+}
+
+//ParseSigningKey parses PEM encoded RSA, ECDSA or Ed25519 private key
+func ParseSigningKey(data []byte) (*SigningKey, error) {
+	block, rest := pem.Decode(data)
+	for block != nil && block.Type == "EC PARAMETERS" {
+		block, rest = pem.Decode(rest)
+	}
+	if block == nil {
+		return nil, errors.New("Signing key must be PEM encoded")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSigningKey(key)
+}
+
+//NewSigningKey wraps private key and chooses signing algorithm for it
+func NewSigningKey(key interface{}) (*SigningKey, error) {
+	var k SigningKey
+	switch private := key.(type) {
+	case *rsa.PrivateKey:
+		k.Method = jwt.SigningMethodRS256
+		k.private = private
+	case *ecdsa.PrivateKey:
+		switch private.Curve {
+		case elliptic.P256():
+			k.Method = jwt.SigningMethodES256
+		case elliptic.P384():
+			k.Method = jwt.SigningMethodES384
+		case elliptic.P521():
+			k.Method = jwt.SigningMethodES512
+		default:
+			return nil, errors.New("Unsupported elliptic curve")
+		}
+		k.private = private
+	case ed25519.PrivateKey:
+		k.Method = verifier.SigningMethodEdDSA
+		k.private = private
+	default:
+		return nil, errors.New("Unsupported signing key type")
+	}
+
+	k.ID = k.JWK().thumbprint()
+	return &k, nil
+}
+
+//GenerateSigningKey generates ephemeral ES256 signing key
+func GenerateSigningKey() (*SigningKey, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return NewSigningKey(private)
+}
+
+//Public returns public part of the key
+func (k *SigningKey) Public() crypto.PublicKey {
+	return k.private.Public()
+}
+
+//JWK returns public part of the key in JWK format
+func (k *SigningKey) JWK() JWK {
+	jwk := JWK{
+		Use: "sig",
+		Alg: k.Method.Alg(),
+		Kid: k.ID,
+	}
+
+	switch public := k.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encodeSegment(public.N.Bytes())
+		jwk.E = encodeSegment(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = public.Curve.Params().Name
+		jwk.X = encodeSegment(padded(public.X.Bytes(), size))
+		jwk.Y = encodeSegment(padded(public.Y.Bytes(), size))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = encodeSegment(public)
+	}
+	return jwk
+}
+
+func (k *SigningKey) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.Method, claims)
+	token.Header["kid"] = k.ID
+	return token.SignedString(k.private)
+}
+
+//thumbprint calculates JWK thumbprint according RFC 7638
+func (jwk JWK) thumbprint() string {
+	var members interface{}
+	switch jwk.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Crv, jwk.Kty, jwk.X, jwk.Y}
+	default:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	}
+
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return encodeSegment(sum[:])
+}
+
+func encodeSegment(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func padded(data []byte, size int) []byte {
+	if len(data) >= size {
+		return data
+	}
+	result := make([]byte, size)
+	copy(result[size-len(data):], data)
+	return result
+}
@@ -76,3 +76,130 @@ func HTTPServer(path string) (*http.Server, error) {
 	}
 	return &server, nil
 }
+
+//DefaultSigningKey is path of signing key used if config doesn't set one. The key is generated on first start
+const DefaultSigningKey = "data/signing.pem"
+
+//AuthConfig contains settings of tokens issuing
+type AuthConfig struct {
+	SigningKey          string
+	PreviousSigningKeys []string
+	Issuer              string
+	Audience            string
+	EmailProviderRules  bool
+	ReservedNicknames   []string
+}
+
+//Auth reads auth settings from config file
+func Auth(path string) (*AuthConfig, error) {
+	cnf, err := process(path)
+	if err != nil {
+		return nil, err
+	}
+	config := AuthConfig{
+		SigningKey: DefaultSigningKey,
+		Issuer:     "go-auth",
+		Audience:   "go-auth",
+	}
+	for key, value := range cnf {
+		switch key {
+		case "Issuer":
+			config.Issuer = value
+		case "Audience":
+			config.Audience = value
+		case "SigningKey":
+			config.SigningKey = value
+		case "PreviousSigningKeys":
+			for _, path := range strings.Split(value, ",") {
+				if path = strings.TrimSpace(path); path != "" {
+					config.PreviousSigningKeys = append(config.PreviousSigningKeys, path)
+				}
+			}
+		case "EmailProviderRules":
+			rules, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, err
+			}
+			config.EmailProviderRules = rules
+		case "ReservedNicknames":
+			for _, nickname := range strings.Split(value, ",") {
+				if nickname = strings.TrimSpace(nickname); nickname != "" {
+					config.ReservedNicknames = append(config.ReservedNicknames, nickname)
+				}
+			}
+		}
+	}
+	return &config, nil
+}
+
+//SessionConfig contains settings of sessions runtime
+type SessionConfig struct {
+	GCInterval  time.Duration
+	Backend     string
+	RedisAddr   string
+	MaxSessions int
+	LimitPolicy string
+	IdleTimeout time.Duration
+	Sliding     bool
+	MaxLifetime time.Duration
+	Binding     string
+}
+
+//Session reads sessions settings from config file
+func Session(path string) (*SessionConfig, error) {
+	cnf, err := process(path)
+	if err != nil {
+		return nil, err
+	}
+	config := SessionConfig{
+		GCInterval:  time.Minute,
+		Backend:     "memory",
+		RedisAddr:   "localhost:6379",
+		LimitPolicy: "reject",
+		Sliding:     true,
+		Binding:     "allow",
+	}
+	for key, value := range cnf {
+		switch key {
+		case "SessionGCInterval":
+			v, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, err
+			}
+			config.GCInterval = time.Second * time.Duration(v)
+		case "SessionBackend":
+			config.Backend = value
+		case "RedisAddr":
+			config.RedisAddr = value
+		case "MaxSessions":
+			v, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, err
+			}
+			config.MaxSessions = v
+		case "SessionLimitPolicy":
+			config.LimitPolicy = value
+		case "SessionIdleTimeout":
+			v, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, err
+			}
+			config.IdleTimeout = time.Second * time.Duration(v)
+		case "SessionSliding":
+			v, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, err
+			}
+			config.Sliding = v
+		case "SessionMaxLifetime":
+			v, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, err
+			}
+			config.MaxLifetime = time.Second * time.Duration(v)
+		case "SessionBindingPolicy":
+			config.Binding = value
+		}
+	}
+	return &config, nil
+}
@@ -1,14 +1,37 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"go-auth/src/actions"
+	"go-auth/src/auth"
 	"go-auth/src/configure"
+	"go-auth/src/session"
 	"go-auth/src/store"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
+	dryRun := flag.Bool("dry-run-migrations", false, "check pending database migrations and exit without applying them")
+	flag.Parse()
+	if *dryRun {
+		pending, err := store.DryRunMigrations("data/store.db")
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, m := range pending {
+			log.Printf("Pending migration %d: %s", m.Version, m.Description)
+		}
+		log.Printf("%d migrations to schema version %d can be applied", len(pending), store.SchemaVersion())
+		return
+	}
+
 	log.Print("Starting service. Reading configs...")
 	configPath := "cnf/server.cnf"
 	server, err := configure.HTTPServer(configPath)
@@ -17,23 +40,153 @@ func main() {
 		server = &http.Server{Addr: ":8080"}
 	}
 
+	authConfig, err := configure.Auth(configPath)
+	if err != nil {
+		authConfig = &configure.AuthConfig{SigningKey: configure.DefaultSigningKey, Issuer: "go-auth", Audience: "go-auth"}
+	}
+	auth.UseIssuer(authConfig.Issuer, authConfig.Audience)
+	store.UseProviderRules(authConfig.EmailProviderRules)
+	store.ReserveNicknames(authConfig.ReservedNicknames...)
+	if authConfig.SigningKey == "" {
+		log.Fatal("SigningKey is not configured")
+	}
+	ring, err := loadKeyring(authConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	auth.UseKeyring(ring)
+	log.Printf("Tokens are signed with %s key '%s'", ring.Active().Method.Alg(), ring.Active().ID)
+	go rotateOnSignal(configPath)
+
 	log.Print("Oppening persistent DB connection...")
 	if err := store.OpenDatabase("data/store.db"); err != nil {
 		log.Fatal(err)
 	}
+	sessionConfig, err := configure.Session(configPath)
+	if err != nil {
+		sessionConfig = &configure.SessionConfig{GCInterval: time.Minute, Backend: "memory", LimitPolicy: "reject", Sliding: true, Binding: "allow"}
+	}
+	sessionStore, err := newSessionStore(sessionConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Keep sessions in %s store", sessionConfig.Backend)
+	policy := session.LimitPolicy(sessionConfig.LimitPolicy)
+	if policy != session.RejectNewSession && policy != session.EvictOldestSession {
+		log.Fatalf("unknown session limit policy %q", sessionConfig.LimitPolicy)
+	}
+	binding := session.BindingPolicy(sessionConfig.Binding)
+	if binding != session.AllowClientMismatch && binding != session.LogClientMismatch && binding != session.ReauthClientMismatch {
+		log.Fatalf("unknown session binding policy %q", sessionConfig.Binding)
+	}
+	options := []session.Option{
+		session.WithGCInterval(sessionConfig.GCInterval),
+		session.WithSessionStore(sessionStore),
+		session.WithSessionLimit(sessionConfig.MaxSessions, policy),
+		session.WithIdleTimeout(sessionConfig.IdleTimeout),
+		session.WithBindingPolicy(binding),
+	}
+	if sessionConfig.Sliding {
+		options = append(options, session.WithSlidingExpiration(sessionConfig.MaxLifetime))
+	} else {
+		options = append(options, session.WithFixedExpiration())
+	}
+	sessions := session.NewManager(options...)
+	sessions.Start(context.Background())
+	auth.UseSessions(sessions)
+	log.Printf("Restored %d sessions", sessions.Rehydrate())
 
 	log.Printf("Serve HTTP on %s", server.Addr)
 	routes()
 
-	if err = server.ListenAndServe(); err != nil {
+	stopped := make(chan struct{})
+	go shutdownOnSignal(server, stopped)
+	if err = server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+	//ListenAndServe returns as soon as shutdown starts, requests in flight still use sessions and database
+	<-stopped
+	sessions.Stop()
 	store.CloseDatabase()
 	log.Println("Server stopped")
 }
 
+func newSessionStore(config *configure.SessionConfig) (session.SessionStore, error) {
+	switch config.Backend {
+	case "memory":
+		return session.NewMemoryStore(session.BoltStore{}, 5*time.Millisecond, time.Now), nil
+	case "bolt":
+		return session.BoltStore{}, nil
+	case "redis":
+		return session.NewRedisStore(config.RedisAddr), nil
+	}
+	return nil, fmt.Errorf("unknown session backend %q", config.Backend)
+}
+
+func loadKeyring(config *configure.AuthConfig) (*auth.Keyring, error) {
+	active, created, err := auth.LoadOrCreateSigningKey(config.SigningKey)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		log.Printf("Signing key is generated and saved to %s", config.SigningKey)
+	}
+
+	previous := make([]*auth.SigningKey, 0, len(config.PreviousSigningKeys))
+	for _, path := range config.PreviousSigningKeys {
+		key, err := auth.LoadSigningKey(path)
+		if err != nil {
+			return nil, err
+		}
+		previous = append(previous, key)
+	}
+	return auth.NewKeyring(active, previous...), nil
+}
+
+//rotateOnSignal re-reads signing key on SIGHUP, so keys can be rotated without restart
+func rotateOnSignal(configPath string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		authConfig, err := configure.Auth(configPath)
+		if err != nil {
+			log.Println("Can't reload signing key:", err)
+			continue
+		}
+		key, err := auth.LoadSigningKey(authConfig.SigningKey)
+		if err != nil {
+			log.Println("Can't reload signing key:", err)
+			continue
+		}
+		auth.RotateSigningKey(key)
+		log.Printf("Tokens are signed with %s key '%s'", key.Method.Alg(), key.ID)
+	}
+}
+
+//shutdownOnSignal gracefully shuts server down on SIGINT or SIGTERM and closes stopped when requests in flight are done
+func shutdownOnSignal(server *http.Server, stopped chan<- struct{}) {
+	defer close(stopped)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	log.Println("Stopping server...")
+	if err := server.Shutdown(context.Background()); err != nil {
+		log.Println(err)
+	}
+}
+
 func routes() {
 	http.HandleFunc("/healthcheck", actions.Run(actions.Healthcheck, http.MethodGet))
+	http.HandleFunc("/.well-known/jwks.json", actions.Run(actions.JWKS, http.MethodGet))
 	http.HandleFunc("/registration", actions.Run(actions.Registration, http.MethodPost))
 	http.HandleFunc("/login", actions.Run(actions.Login, http.MethodPost))
+	http.HandleFunc("/refresh", actions.Run(actions.Refresh, http.MethodPost))
+	http.HandleFunc("/logout", actions.Run(actions.Logout, http.MethodPost))
+	http.HandleFunc("/revoke", actions.Run(actions.Revoke, http.MethodPost))
+	http.HandleFunc("/logout-all", actions.RunAuthenticated(actions.LogoutAll, http.MethodPost))
+	http.HandleFunc("/password", actions.RunAuthenticated(actions.ChangePassword, http.MethodPost))
+	http.HandleFunc("/email", actions.RunAuthenticated(actions.ChangeEmail, http.MethodPost))
+	http.HandleFunc("/sessions", actions.RunAuthenticated(actions.Sessions, http.MethodGet))
+	http.HandleFunc("/sessions/", actions.RunAuthenticated(actions.EndSession, http.MethodDelete))
 }
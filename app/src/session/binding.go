@@ -0,0 +1,108 @@
+package session
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+)
+
+//BindingPolicy defines what happens when session is refreshed by client other than the one which logged in
+type BindingPolicy string
+
+//Session binding policies
+const (
+	AllowClientMismatch  BindingPolicy = "allow"
+	LogClientMismatch    BindingPolicy = "log"
+	ReauthClientMismatch BindingPolicy = "reauth"
+)
+
+//ErrClientMismatch returned when session is refreshed by another client and re-authentication is required
+var ErrClientMismatch = errors.New("Session belongs to another client. Log in again")
+
+//uaFamilies are User-Agent product tokens recognized as client families. Order matters,
+//browsers mention products they are compatible with, e.g. Chrome mentions Safari
+var uaFamilies = []struct {
+	token  string
+	family string
+}{
+	{"Edg/", "Edge"},
+	{"OPR/", "Opera"},
+	{"Firefox/", "Firefox"},
+	{"Chrome/", "Chrome"},
+	{"CriOS/", "Chrome"},
+	{"Safari/", "Safari"},
+	{"MSIE ", "IE"},
+	{"Trident/", "IE"},
+}
+
+//Fingerprint is a coarse identity of the client. It survives changes of address within
+//the network and browser updates, but not moving the token to another network or program
+type Fingerprint struct {
+	IPPrefix string
+	UAFamily string
+}
+
+//NewFingerprint makes fingerprint of the client from its address and User-Agent.
+//IPv4 addresses are reduced to /24 network, IPv6 ones to /48
+func NewFingerprint(ip string, userAgent string) Fingerprint {
+	return Fingerprint{
+		IPPrefix: ipPrefix(ip),
+		UAFamily: uaFamily(userAgent),
+	}
+}
+
+func ipPrefix(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return addr.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+func uaFamily(userAgent string) string {
+	for _, f := range uaFamilies {
+		if strings.Contains(userAgent, f.token) {
+			return f.family
+		}
+	}
+	//Non-browser clients such as curl/7.68.0 are identified by the first product name
+	product := strings.Fields(userAgent)
+	if len(product) == 0 {
+		return ""
+	}
+	return strings.SplitN(product[0], "/", 2)[0]
+}
+
+//Fingerprint returns fingerprint of the client which started the session
+func (s *Session) Fingerprint() Fingerprint {
+	return NewFingerprint(s.ip, s.userAgent)
+}
+
+//Bind compares client which refreshes the session with the one which started it. On mismatch
+//session is used as is, the mismatch is logged or the session is revoked with ErrClientMismatch
+//according binding policy. Sessions without recorded client, e.g. started before clients were recorded, are not bound
+func (m *Manager) Bind(s *Session, ip string, userAgent string) error {
+	if m.bindingPolicy == AllowClientMismatch || s.ip == "" && s.userAgent == "" {
+		return nil
+	}
+
+	recorded, current := s.Fingerprint(), NewFingerprint(ip, userAgent)
+	if recorded == current {
+		return nil
+	}
+
+	log.Printf("Security event: session '%s' of user %s started by %s (%s) is refreshed by %s (%s)",
+		s.family, s.emial, recorded.IPPrefix, recorded.UAFamily, current.IPPrefix, current.UAFamily)
+	if m.bindingPolicy != ReauthClientMismatch {
+		return nil
+	}
+
+	if err := m.Revoke(s, RevokedOnClientMismatch); err != nil {
+		return err
+	}
+	return ErrClientMismatch
+}
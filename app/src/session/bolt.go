@@ -0,0 +1,127 @@
+package session
+
+import (
+	"go-auth/src/store"
+)
+
+//BoltStore keeps sessions in the token store of store package, bolt unless changed with store.UseStores.
+//It is also used as persistent store of MemoryStore
+type BoltStore struct{}
+
+//AddRenewTokens writes renew tokens in one transaction
+func (BoltStore) AddRenewTokens(tokens []store.RenewToken) error {
+	return store.AddRenewTokens(tokens)
+}
+
+//GetAllRenewTokens returns all unexpired renew tokens
+func (BoltStore) GetAllRenewTokens() []store.RenewToken {
+	return store.GetAllRenewTokens()
+}
+
+//GetRenewToken returns unexpired renew token by digest
+func (BoltStore) GetRenewToken(digest string) (bool, *store.RenewToken) {
+	return store.GetRenewToken(digest)
+}
+
+//RetireRenewToken marks renew token as exchanged
+func (BoltStore) RetireRenewToken(digest string) (bool, error) {
+	return store.RetireRenewToken(digest)
+}
+
+//DeleteRenewToken deletes renew token by digest
+func (BoltStore) DeleteRenewToken(digest string) error {
+	return store.DeleteRenewToken(digest)
+}
+
+//DeleteRenewFamily deletes all renew tokens of the family
+func (BoltStore) DeleteRenewFamily(family string) error {
+	return store.DeleteRenewFamily(family)
+}
+
+//DeleteUserRenewTokens deletes all renew tokens of the user
+func (BoltStore) DeleteUserRenewTokens(userID string) error {
+	return store.DeleteUserRenewTokens(userID)
+}
+
+//ClearRenewTokens deletes renew tokens expired before now
+func (BoltStore) ClearRenewTokens(now int64) ([]store.RenewToken, error) {
+	return store.ClearRenewTokens(now)
+}
+
+//AddRevokedToken writes ID of revoked auth token
+func (BoltStore) AddRevokedToken(id string, expireAt int64) error {
+	return store.AddRevokedToken(id, expireAt)
+}
+
+//IsTokenRevoked checks if auth token with the ID was revoked
+func (BoltStore) IsTokenRevoked(id string) (bool, error) {
+	return store.IsTokenRevoked(id)
+}
+
+//ClearRevokedTokens deletes IDs of revoked auth tokens expired before now
+func (BoltStore) ClearRevokedTokens(now int64) error {
+	return store.ClearRevokedTokens(now)
+}
+
+//Put writes session into bolt
+func (BoltStore) Put(token string, s *Session) error {
+	return store.AddRenewToken(s.renewToken(token))
+}
+
+//Get reads unexpired session from bolt
+func (BoltStore) Get(token string) (*Session, error) {
+	found, t := store.GetRenewToken(token)
+	if !found {
+		return nil, nil
+	}
+	return Restore(t), nil
+}
+
+//Delete deletes session from bolt
+func (BoltStore) Delete(token string) error {
+	return store.DeleteRenewToken(token)
+}
+
+//Retire marks token as exchanged in one transaction
+func (BoltStore) Retire(token string) (bool, error) {
+	return store.RetireRenewToken(token)
+}
+
+//DeleteFamily deletes sessions of the family from bolt
+func (BoltStore) DeleteFamily(family string) error {
+	return store.DeleteRenewFamily(family)
+}
+
+//DeleteUser deletes sessions of the user from bolt
+func (BoltStore) DeleteUser(userID string) error {
+	return store.DeleteUserRenewTokens(userID)
+}
+
+//UserSessions reads unexpired sessions of the user from bolt
+func (BoltStore) UserSessions(userID string) (map[string]*Session, error) {
+	sessions := make(map[string]*Session)
+	for _, t := range store.GetUserRenewTokens(userID) {
+		sessions[t.Digest] = Restore(&t)
+	}
+	return sessions, nil
+}
+
+//RevokeToken writes ID of revoked auth token into bolt
+func (BoltStore) RevokeToken(id string, expireAt int64) error {
+	return store.AddRevokedToken(id, expireAt)
+}
+
+//Collect deletes sessions and revoked auth tokens expired before now from bolt
+func (BoltStore) Collect(now int64) ([]*Session, error) {
+	cleared, err := store.ClearRenewTokens(now)
+	if err == nil {
+		err = store.ClearRevokedTokens(now)
+	}
+	var expired []*Session
+	for i := range cleared {
+		if !cleared[i].Retired {
+			expired = append(expired, Restore(&cleared[i]))
+		}
+	}
+	return expired, err
+}
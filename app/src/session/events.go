@@ -0,0 +1,120 @@
+package session
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+//EventType is a kind of session lifecycle event
+type EventType string
+
+//Session lifecycle events
+const (
+	SessionCreated   EventType = "created"
+	SessionRefreshed EventType = "refreshed"
+	SessionExpired   EventType = "expired"
+	SessionRevoked   EventType = "revoked"
+)
+
+//Reasons of session revocation
+const (
+	RevokedByLogout         = "logout"
+	RevokedByLogoutAll      = "logout_all"
+	RevokedByPasswordChange = "password_change"
+	RevokedByEmailChange    = "email_change"
+	RevokedByUser           = "ended_by_user"
+	RevokedByRequest        = "revocation_request"
+	RevokedOnTokenReuse     = "token_reuse"
+	RevokedByEviction       = "evicted"
+	RevokedOnClientMismatch = "client_mismatch"
+)
+
+const eventsBuffer = 1024
+
+//Event describes change of a session. Session is identified by user ID and renew tokens family,
+//Email is the one user had at login
+type Event struct {
+	Type   EventType
+	UserID string
+	Email  string
+	Family string
+	Reason string
+	Time   time.Time
+}
+
+//Subscribe registers handler of session events. Handlers are called one by one by dispatcher goroutine,
+//so slow handler delays others. Returns function which cancels the subscription
+func (m *Manager) Subscribe(handler func(Event)) func() {
+	m.subscribersMutex.Lock()
+	defer m.subscribersMutex.Unlock()
+
+	id := m.nextSubscriber
+	m.nextSubscriber++
+	m.subscribers[id] = handler
+
+	return func() {
+		m.subscribersMutex.Lock()
+		defer m.subscribersMutex.Unlock()
+
+		delete(m.subscribers, id)
+	}
+}
+
+//emit queues event of the session for subscribers. Events are dropped if subscribers fall behind
+func (m *Manager) emit(eventType EventType, s *Session, reason string) {
+	m.subscribersMutex.RLock()
+	subscribed := len(m.subscribers) > 0
+	m.subscribersMutex.RUnlock()
+	if !subscribed {
+		return
+	}
+
+	e := Event{
+		Type:   eventType,
+		UserID: s.userID,
+		Email:  s.emial,
+		Family: s.family,
+		Reason: reason,
+		Time:   m.now(),
+	}
+
+	select {
+	case m.events <- e:
+	default:
+		log.Printf("Session event '%s' of family '%s' is dropped, subscribers are too slow", e.Type, e.Family)
+	}
+}
+
+//dispatcher delivers events to subscribers. Queued events are delivered before dispatcher stops
+func (m *Manager) dispatcher(ctx context.Context) {
+	for {
+		select {
+		case e := <-m.events:
+			m.dispatch(e)
+		case <-ctx.Done():
+			for {
+				select {
+				case e := <-m.events:
+					m.dispatch(e)
+				default:
+					close(m.dispatched)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (m *Manager) dispatch(e Event) {
+	m.subscribersMutex.RLock()
+	handlers := make([]func(Event), 0, len(m.subscribers))
+	for _, handler := range m.subscribers {
+		handlers = append(handlers, handler)
+	}
+	m.subscribersMutex.RUnlock()
+
+	for _, handler := range handlers {
+		handler(e)
+	}
+}
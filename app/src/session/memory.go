@@ -0,0 +1,384 @@
+package session
+
+import (
+	"go-auth/src/store"
+	"sync"
+	"time"
+)
+
+type writeItem struct {
+	token    store.RenewToken
+	feedback chan error
+}
+
+const maxWriteBatch = 256
+
+const defaultShards = 64
+
+//Persistent persists renew tokens of in-memory sessions
+type Persistent interface {
+	AddRenewTokens(tokens []store.RenewToken) error
+	GetAllRenewTokens() []store.RenewToken
+	GetRenewToken(digest string) (bool, *store.RenewToken)
+	RetireRenewToken(digest string) (bool, error)
+	DeleteRenewToken(digest string) error
+	DeleteRenewFamily(family string) error
+	DeleteUserRenewTokens(userID string) error
+	ClearRenewTokens(now int64) ([]store.RenewToken, error)
+	AddRevokedToken(id string, expireAt int64) error
+	IsTokenRevoked(id string) (bool, error)
+	ClearRevokedTokens(now int64) error
+}
+
+//shard keeps part of sessions. Tokens are indexed by user ID and by family in the shard which keeps them
+type shard struct {
+	sync.RWMutex
+	sessions    map[string]Session
+	userIndex   map[string]map[string]bool
+	familyIndex map[string]map[string]bool
+}
+
+//MemoryStore keeps sessions in maps split into shards by token, each shard has own lock.
+//New sessions are written into persistent store by writer goroutine in batches
+type MemoryStore struct {
+	writeLatency time.Duration
+	now          func() time.Time
+	persistent   Persistent
+
+	shards      []*shard
+	writeStream chan *writeItem
+
+	//writerMutex guards running, Put holds it for reading while its session is passed to writer
+	writerMutex sync.RWMutex
+	running     bool
+	quit        chan struct{}
+	done        chan struct{}
+}
+
+//NewMemoryStore creates in-memory session store backed by persistent store
+func NewMemoryStore(persistent Persistent, writeLatency time.Duration, now func() time.Time) *MemoryStore {
+	return newMemoryStore(persistent, writeLatency, now, defaultShards)
+}
+
+func newMemoryStore(persistent Persistent, writeLatency time.Duration, now func() time.Time, shards int) *MemoryStore {
+	m := &MemoryStore{
+		writeLatency: writeLatency,
+		now:          now,
+		persistent:   persistent,
+		shards:       make([]*shard, shards),
+		writeStream:  make(chan *writeItem),
+	}
+	for i := range m.shards {
+		m.shards[i] = &shard{
+			sessions:    make(map[string]Session),
+			userIndex:   make(map[string]map[string]bool),
+			familyIndex: make(map[string]map[string]bool),
+		}
+	}
+	return m
+}
+
+func (m *MemoryStore) start() {
+	m.writerMutex.Lock()
+	defer m.writerMutex.Unlock()
+
+	if m.running {
+		return
+	}
+	m.quit = make(chan struct{})
+	m.done = make(chan struct{})
+	m.running = true
+
+	go m.writer()
+}
+
+//Close stops writer if it is running. Sessions put afterwards are written into persistent store directly
+func (m *MemoryStore) Close() error {
+	m.writerMutex.Lock()
+	defer m.writerMutex.Unlock()
+
+	if m.running {
+		close(m.quit)
+		<-m.done
+		m.running = false
+	}
+	return nil
+}
+
+//shard returns shard of the token by its FNV-1a hash
+func (m *MemoryStore) shard(token string) *shard {
+	h := uint32(2166136261)
+	for i := 0; i < len(token); i++ {
+		h ^= uint32(token[i])
+		h *= 16777619
+	}
+	return m.shards[h%uint32(len(m.shards))]
+}
+
+//put writes session and indexes it. Caller must hold the lock
+func (s *shard) put(token string, session Session) {
+	s.delete(token)
+	s.sessions[token] = session
+	addToIndex(s.userIndex, session.userID, token)
+	addToIndex(s.familyIndex, session.family, token)
+}
+
+//delete removes session and its index entries. Caller must hold the lock
+func (s *shard) delete(token string) bool {
+	session, ok := s.sessions[token]
+	if !ok {
+		return false
+	}
+
+	delete(s.sessions, token)
+	removeFromIndex(s.userIndex, session.userID, token)
+	removeFromIndex(s.familyIndex, session.family, token)
+	return true
+}
+
+func addToIndex(index map[string]map[string]bool, key string, token string) {
+	if index[key] == nil {
+		index[key] = make(map[string]bool)
+	}
+	index[key][token] = true
+}
+
+func removeFromIndex(index map[string]map[string]bool, key string, token string) {
+	delete(index[key], token)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
+
+//garbageCollector removes expired sessions. Adds expired sessions of not retired tokens to expired
+func (s *shard) garbageCollector(now int64, expired map[string]*Session) {
+	s.Lock()
+	defer s.Unlock()
+
+	for token, session := range s.sessions {
+		if session.expireAt < now {
+			s.delete(token)
+			if !session.retired {
+				session := session
+				expired[token] = &session
+			}
+		}
+	}
+}
+
+//garbageCollector removes expired sessions from memory shard by shard. Returns expired sessions of not retired tokens
+func (m *MemoryStore) garbageCollector(now int64) map[string]*Session {
+	expired := make(map[string]*Session)
+	for _, s := range m.shards {
+		s.garbageCollector(now, expired)
+	}
+	return expired
+}
+
+//writer commits new sessions into the store. First session of a batch waits
+//for others not longer than writeLatency
+func (m *MemoryStore) writer() {
+	for {
+		var batch []*writeItem
+		select {
+		case itm := <-m.writeStream:
+			batch = append(batch, itm)
+		case <-m.quit:
+			close(m.done)
+			return
+		}
+
+		timer := time.NewTimer(m.writeLatency)
+	collect:
+		for len(batch) < maxWriteBatch {
+			select {
+			case itm := <-m.writeStream:
+				batch = append(batch, itm)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		tokens := make([]store.RenewToken, len(batch))
+		for i, itm := range batch {
+			tokens[i] = itm.token
+		}
+		err := m.persistent.AddRenewTokens(tokens)
+		for _, itm := range batch {
+			itm.feedback <- err
+		}
+	}
+}
+
+func (m *MemoryStore) write(token string, session *Session) {
+	s := m.shard(token)
+	s.Lock()
+	s.put(token, *session)
+	s.Unlock()
+}
+
+func (m *MemoryStore) read(token string) (*Session, bool) {
+	s := m.shard(token)
+	s.RLock()
+	session, ok := s.sessions[token]
+	s.RUnlock()
+	return &session, ok
+}
+
+//rehydrate loads all unexpired renew tokens from persistent store into memory
+func (m *MemoryStore) rehydrate() int {
+	tokens := m.persistent.GetAllRenewTokens()
+	for i := range tokens {
+		m.write(tokens[i].Digest, Restore(&tokens[i]))
+	}
+	return len(tokens)
+}
+
+//Put writes unexpired session into persistent store and then into memory
+func (m *MemoryStore) Put(token string, s *Session) error {
+	if m.now().Unix() < s.expireAt {
+		if err := m.persist(s.renewToken(token)); err != nil {
+			return err
+		}
+	}
+
+	m.write(token, s)
+	return nil
+}
+
+//persist passes token to writer or writes it into persistent store directly when writer isn't running
+func (m *MemoryStore) persist(token store.RenewToken) error {
+	m.writerMutex.RLock()
+	defer m.writerMutex.RUnlock()
+
+	if !m.running {
+		return m.persistent.AddRenewTokens([]store.RenewToken{token})
+	}
+
+	w := writeItem{
+		token:    token,
+		feedback: make(chan error, 1),
+	}
+	m.writeStream <- &w
+	return <-w.feedback
+}
+
+//Get looks for session in memory and then in persistent store.
+//Session found in persistent store is put back into memory
+func (m *MemoryStore) Get(token string) (*Session, error) {
+	if s, ok := m.read(token); ok {
+		return s, nil
+	}
+
+	found, t := m.persistent.GetRenewToken(token)
+	if !found {
+		return nil, nil
+	}
+
+	s := Restore(t)
+	m.write(token, s)
+	return s, nil
+}
+
+//Delete removes session from memory and persistent store
+func (m *MemoryStore) Delete(token string) error {
+	s := m.shard(token)
+	s.Lock()
+	s.delete(token)
+	s.Unlock()
+
+	return m.persistent.DeleteRenewToken(token)
+}
+
+//Retire marks token as exchanged in memory and persistent store
+func (m *MemoryStore) Retire(token string) (bool, error) {
+	if s, err := m.Get(token); s == nil || err != nil {
+		return false, err
+	}
+
+	s := m.shard(token)
+	s.Lock()
+	session, ok := s.sessions[token]
+	ok = ok && !session.retired
+	if ok {
+		session.retired = true
+		s.sessions[token] = session
+	}
+	s.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+	_, err := m.persistent.RetireRenewToken(token)
+	return true, err
+}
+
+//DeleteFamily removes sessions of the family from memory and persistent store
+func (m *MemoryStore) DeleteFamily(family string) error {
+	for _, s := range m.shards {
+		s.Lock()
+		for token := range s.familyIndex[family] {
+			s.delete(token)
+		}
+		s.Unlock()
+	}
+	return m.persistent.DeleteRenewFamily(family)
+}
+
+//DeleteUser removes sessions of the user from memory and persistent store
+func (m *MemoryStore) DeleteUser(userID string) error {
+	for _, s := range m.shards {
+		s.Lock()
+		for token := range s.userIndex[userID] {
+			s.delete(token)
+		}
+		s.Unlock()
+	}
+	return m.persistent.DeleteUserRenewTokens(userID)
+}
+
+//RevokeToken writes ID of revoked auth token straight into persistent store, so it survives restart
+func (m *MemoryStore) RevokeToken(id string, expireAt int64) error {
+	return m.persistent.AddRevokedToken(id, expireAt)
+}
+
+//IsTokenRevoked checks if auth token with the ID is revoked in persistent store
+func (m *MemoryStore) IsTokenRevoked(id string) (bool, error) {
+	return m.persistent.IsTokenRevoked(id)
+}
+
+//UserSessions returns sessions of the user kept in memory
+func (m *MemoryStore) UserSessions(userID string) (map[string]*Session, error) {
+	sessions := make(map[string]*Session)
+	for _, s := range m.shards {
+		s.RLock()
+		for token := range s.userIndex[userID] {
+			session := s.sessions[token]
+			sessions[token] = &session
+		}
+		s.RUnlock()
+	}
+	return sessions, nil
+}
+
+//Collect removes expired sessions from memory and then clears them and revoked auth tokens in persistent store.
+//Session expired in both is reported once
+func (m *MemoryStore) Collect(now int64) ([]*Session, error) {
+	expired := m.garbageCollector(now)
+	cleared, err := m.persistent.ClearRenewTokens(now)
+	if err == nil {
+		err = m.persistent.ClearRevokedTokens(now)
+	}
+	for i := range cleared {
+		if _, ok := expired[cleared[i].Digest]; !ok && !cleared[i].Retired {
+			expired[cleared[i].Digest] = Restore(&cleared[i])
+		}
+	}
+
+	sessions := make([]*Session, 0, len(expired))
+	for _, s := range expired {
+		sessions = append(sessions, s)
+	}
+	return sessions, err
+}
@@ -0,0 +1,430 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-auth/src/store"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const maxIdleRedisConns = 8
+
+//RedisError is an error reply of Redis server
+type RedisError string
+
+func (e RedisError) Error() string {
+	return "redis: " + string(e)
+}
+
+var errRedisProtocol = errors.New("redis: unexpected reply")
+
+//RedisStore keeps sessions in Redis 7 or newer, or any server speaking its protocol.
+//Expired sessions are removed by Redis key TTL. Keys are:
+//	<prefix>token:<digest>   - session record
+//	<prefix>retired:<digest> - marker of exchanged token
+//	<prefix>family:<family>  - set of token digests of the family, expires with its longest session
+//	<prefix>revoked:<jti>    - marker of revoked auth token, expires with the token
+//	<prefix>user:<user ID>   - sorted set of token digests of the user scored by expiration time, expires with
+//	                           its longest session. Digests of expired sessions are pruned on write
+type RedisStore struct {
+	addr    string
+	prefix  string
+	timeout time.Duration
+	now     func() time.Time
+
+	mutex sync.Mutex
+	idle  []*redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+//NewRedisStore creates session store of Redis server at addr
+func NewRedisStore(addr string) *RedisStore {
+	return &RedisStore{
+		addr:    addr,
+		prefix:  "session:",
+		timeout: 5 * time.Second,
+		now:     time.Now,
+	}
+}
+
+//Close closes idle connections
+func (r *RedisStore) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, c := range r.idle {
+		c.conn.Close()
+	}
+	r.idle = nil
+	return nil
+}
+
+func (r *RedisStore) tokenKey(token string) string {
+	return r.prefix + "token:" + token
+}
+
+func (r *RedisStore) retiredKey(token string) string {
+	return r.prefix + "retired:" + token
+}
+
+func (r *RedisStore) familyKey(family string) string {
+	return r.prefix + "family:" + family
+}
+
+func (r *RedisStore) userKey(userID string) string {
+	return r.prefix + "user:" + userID
+}
+
+func (r *RedisStore) revokedKey(id string) string {
+	return r.prefix + "revoked:" + id
+}
+
+//Put writes session with TTL till its expiration and indexes it in one transaction, so session is never
+//left out of its family or user index. Expired sessions are not written
+func (r *RedisStore) Put(token string, s *Session) error {
+	now := r.now().Unix()
+	ttl := s.expireAt - now
+	if ttl <= 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(s.renewToken(token))
+	if err != nil {
+		return err
+	}
+	expire := strconv.FormatInt(ttl, 10)
+
+	commands := [][]string{{"SET", r.tokenKey(token), string(data), "EX", expire}}
+	if s.retired {
+		commands = append(commands, []string{"SET", r.retiredKey(token), "1", "EX", expire})
+	}
+	commands = append(commands, []string{"SADD", r.familyKey(s.family), token})
+	commands = append(commands, extendTTL(r.familyKey(s.family), expire)...)
+	commands = append(commands,
+		[]string{"ZADD", r.userKey(s.userID), strconv.FormatInt(s.expireAt, 10), token},
+		[]string{"ZREMRANGEBYSCORE", r.userKey(s.userID), "-inf", strconv.FormatInt(now, 10)},
+	)
+	commands = append(commands, extendTTL(r.userKey(s.userID), expire)...)
+
+	_, err = r.multi(commands...)
+	return err
+}
+
+//extendTTL returns commands which set TTL of the key unless it already lives longer. NX sets TTL of new key,
+//GT extends TTL of existing one
+func extendTTL(key string, ttl string) [][]string {
+	return [][]string{
+		{"EXPIRE", key, ttl, "NX"},
+		{"EXPIRE", key, ttl, "GT"},
+	}
+}
+
+//Get reads session and its retired marker
+func (r *RedisStore) Get(token string) (*Session, error) {
+	reply, err := r.do("MGET", r.tokenKey(token), r.retiredKey(token))
+	if err != nil {
+		return nil, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return nil, errRedisProtocol
+	}
+
+	data, ok := values[0].(string)
+	if !ok {
+		return nil, nil
+	}
+
+	var t store.RenewToken
+	if err := json.Unmarshal([]byte(data), &t); err != nil {
+		return nil, err
+	}
+	t.Retired = values[1] != nil
+	return Restore(&t), nil
+}
+
+//Delete deletes session and its retired marker
+func (r *RedisStore) Delete(token string) error {
+	_, err := r.do("DEL", r.tokenKey(token), r.retiredKey(token))
+	return err
+}
+
+//Retire sets retired marker with SET NX, so only one of concurrent callers succeeds
+func (r *RedisStore) Retire(token string) (bool, error) {
+	s, err := r.Get(token)
+	if s == nil || err != nil {
+		return false, err
+	}
+
+	ttl := s.expireAt - r.now().Unix()
+	if ttl <= 0 {
+		return false, nil
+	}
+
+	reply, err := r.do("SET", r.retiredKey(token), "1", "EX", strconv.FormatInt(ttl, 10), "NX")
+	if err != nil {
+		return false, err
+	}
+	return reply == "OK", nil
+}
+
+//DeleteFamily deletes sessions of all family members and the family set
+func (r *RedisStore) DeleteFamily(family string) error {
+	return r.deleteMembers(r.familyKey(family), "SMEMBERS", r.familyKey(family))
+}
+
+//DeleteUser deletes all sessions of the user and the user set
+func (r *RedisStore) DeleteUser(userID string) error {
+	return r.deleteMembers(r.userKey(userID), "ZRANGE", r.userKey(userID), "0", "-1")
+}
+
+//UserSessions reads sessions of unexpired tokens in the user set. Tokens of deleted sessions are removed from the set
+func (r *RedisStore) UserSessions(userID string) (map[string]*Session, error) {
+	members, err := r.members("ZRANGEBYSCORE", r.userKey(userID), "("+strconv.FormatInt(r.now().Unix(), 10), "+inf")
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make(map[string]*Session)
+	deleted := []string{"ZREM", r.userKey(userID)}
+	for _, token := range members {
+		s, err := r.Get(token)
+		if err != nil {
+			return nil, err
+		}
+		if s != nil {
+			sessions[token] = s
+		} else {
+			deleted = append(deleted, token)
+		}
+	}
+
+	if len(deleted) > 2 {
+		if _, err := r.do(deleted...); err != nil {
+			return nil, err
+		}
+	}
+	return sessions, nil
+}
+
+//deleteMembers deletes sessions of all tokens listed by command and the set itself
+func (r *RedisStore) deleteMembers(set string, list ...string) error {
+	members, err := r.members(list...)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{"DEL", set}
+	for _, token := range members {
+		keys = append(keys, r.tokenKey(token), r.retiredKey(token))
+	}
+	_, err = r.do(keys...)
+	return err
+}
+
+//members runs command which lists set members
+func (r *RedisStore) members(args ...string) ([]string, error) {
+	reply, err := r.do(args...)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok {
+		return nil, errRedisProtocol
+	}
+
+	members := make([]string, len(values))
+	for i, value := range values {
+		if members[i], ok = value.(string); !ok {
+			return nil, errRedisProtocol
+		}
+	}
+	return members, nil
+}
+
+//RevokeToken sets revoked marker with TTL till expiration of auth token. Expired tokens are not written
+func (r *RedisStore) RevokeToken(id string, expireAt int64) error {
+	ttl := expireAt - r.now().Unix()
+	if ttl <= 0 {
+		return nil
+	}
+	_, err := r.do("SET", r.revokedKey(id), "1", "EX", strconv.FormatInt(ttl, 10))
+	return err
+}
+
+//IsTokenRevoked checks if revoked marker of auth token exists
+func (r *RedisStore) IsTokenRevoked(id string) (bool, error) {
+	reply, err := r.do("GET", r.revokedKey(id))
+	return reply != nil, err
+}
+
+//Collect does nothing, Redis expires sessions and revoked auth tokens by itself. So no expired events are reported
+func (r *RedisStore) Collect(now int64) ([]*Session, error) {
+	return nil, nil
+}
+
+//do sends command and reads its reply. Replies are string, int64, []interface{} or nil
+func (r *RedisStore) do(args ...string) (interface{}, error) {
+	replies, err := r.pipeline([][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := replies[0].(RedisError); ok {
+		return nil, e
+	}
+	return replies[0], nil
+}
+
+//multi runs commands in MULTI/EXEC transaction and returns their replies.
+//Error of any command is returned as error of the transaction
+func (r *RedisStore) multi(commands ...[]string) ([]interface{}, error) {
+	transaction := append([][]string{{"MULTI"}}, commands...)
+	transaction = append(transaction, []string{"EXEC"})
+
+	replies, err := r.pipeline(transaction)
+	if err != nil {
+		return nil, err
+	}
+	for _, reply := range replies {
+		if e, ok := reply.(RedisError); ok {
+			return nil, e
+		}
+	}
+	results, ok := replies[len(replies)-1].([]interface{})
+	if !ok {
+		return nil, errRedisProtocol
+	}
+	for _, result := range results {
+		if e, ok := result.(RedisError); ok {
+			return nil, e
+		}
+	}
+	return results, nil
+}
+
+//pipeline sends commands at once and reads their replies. Error replies are returned as RedisError values
+func (r *RedisStore) pipeline(commands [][]string) ([]interface{}, error) {
+	c, err := r.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+	for _, args := range commands {
+		buf = append(buf, encodeCommand(args)...)
+	}
+	c.conn.SetDeadline(time.Now().Add(r.timeout))
+	if _, err := c.conn.Write(buf); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+
+	replies := make([]interface{}, len(commands))
+	for i := range replies {
+		if replies[i], err = c.read(); err != nil {
+			if e, ok := err.(RedisError); ok {
+				replies[i] = e
+				continue
+			}
+			c.conn.Close()
+			return nil, err
+		}
+	}
+
+	r.release(c)
+	return replies, nil
+}
+
+func (r *RedisStore) conn() (*redisConn, error) {
+	r.mutex.Lock()
+	if n := len(r.idle); n > 0 {
+		c := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mutex.Unlock()
+		return c, nil
+	}
+	r.mutex.Unlock()
+
+	conn, err := net.DialTimeout("tcp", r.addr, r.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &redisConn{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (r *RedisStore) release(c *redisConn) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.idle) >= maxIdleRedisConns {
+		c.conn.Close()
+		return
+	}
+	r.idle = append(r.idle, c)
+}
+
+func encodeCommand(args []string) []byte {
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+	}
+	return buf
+}
+
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errRedisProtocol
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, RedisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = c.read(); err != nil {
+				//Errors of commands in EXEC reply are values, the rest of reply is still read
+				if e, ok := err.(RedisError); ok {
+					values[i] = e
+					continue
+				}
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, errRedisProtocol
+}
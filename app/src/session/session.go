@@ -1,137 +1,558 @@
 package session
 
 import (
+	"context"
+	"errors"
 	"go-auth/src/store"
+	"io"
+	"log"
+	"sort"
 	"sync"
 	"time"
 )
 
-type operation int
+//Session stuct for session data storing. All renew tokens issued by rotation of
+//the first one belong to the same family. Session ends at maxExpireAt, its renew token
+//expires earlier if idle timeout is set. Sessions belong to user ID, email is the one user had at login
+type Session struct {
+	userID      string
+	emial       string
+	family      string
+	expireAt    int64
+	maxExpireAt int64
+	retired     bool
 
-var stream chan *sessionItem
-var streamMutex sync.RWMutex
-var flushStream []sessionItem
+	createdAt   int64
+	refreshedAt int64
+	ip          string
+	userAgent   string
+}
 
-var sessionStore map[string]Session
+//SessionStore keeps sessions by renew token digest. Implementations must be safe for concurrent use
+type SessionStore interface {
+	//Put stores session of the token
+	Put(token string, s *Session) error
+	//Get returns session of the token or nil if token is unknown
+	Get(token string) (*Session, error)
+	//Delete removes session of the token
+	Delete(token string) error
+	//Retire marks token as exchanged. Returns false if token is unknown or already retired
+	Retire(token string) (bool, error)
+	//DeleteFamily removes sessions of all tokens of the family
+	DeleteFamily(family string) error
+	//DeleteUser removes all sessions of the user with the ID
+	DeleteUser(userID string) error
+	//UserSessions returns sessions of the user with the ID by token
+	UserSessions(userID string) (map[string]*Session, error)
+	//RevokeToken keeps ID of revoked auth token till expireAt, so replicas sharing the store reject it
+	RevokeToken(id string, expireAt int64) error
+	//IsTokenRevoked returns true if auth token with the ID was revoked
+	IsTokenRevoked(id string) (bool, error)
+	//Collect removes sessions and revoked auth tokens expired before now. Returns expired sessions
+	//of not retired tokens, stores which expire sessions by themselves return none
+	Collect(now int64) ([]*Session, error)
+}
 
+//LimitPolicy defines what happens when user with the maximum of active sessions logs in
+type LimitPolicy string
+
+//Session limit policies
 const (
-	read operation = iota
-	write
-	gc
+	RejectNewSession   LimitPolicy = "reject"
+	EvictOldestSession LimitPolicy = "evict"
 )
 
-//Session stuct for session data storing
-type Session struct {
-	emial    string
-	expireAt int64
+//ErrSessionLimit returned when user has the maximum of active sessions and new ones are rejected
+var ErrSessionLimit = errors.New("Active sessions limit is reached")
+
+//starter is implemented by session stores which run their own goroutines
+type starter interface {
+	start()
 }
 
-type sessionItem struct {
-	session  *Session
-	token    string
-	op       operation
-	feedback chan bool
+//rehydrator is implemented by session stores which load sessions from persistent store on startup
+type rehydrator interface {
+	rehydrate() int
 }
 
-func init() {
-	stream = make(chan *sessionItem)
-	flushStream = make([]sessionItem, 0)
-	sessionStore = make(map[string]Session)
+//Manager owns sessions lifecycle. Sessions are kept by SessionStore, expired ones are collected periodically
+type Manager struct {
+	interval time.Duration
+	now      func() time.Time
+	store    SessionStore
+
+	writeLatency time.Duration
+	persistent   Persistent
+
+	limit       int
+	limitPolicy LimitPolicy
+	openMutex   sync.Mutex
+
+	idleTimeout time.Duration
+	fixed       bool
+	maxLifetime time.Duration
 
-	go runtime()
+	bindingPolicy BindingPolicy
 
-	scheduler(60)
+	events           chan Event
+	subscribers      map[int]func(Event)
+	nextSubscriber   int
+	subscribersMutex sync.RWMutex
+
+	collectHooks      []func(now int64)
+	collectHooksMutex sync.Mutex
+
+	notifier   chan bool
+	cancel     context.CancelFunc
+	done       chan struct{}
+	dispatched chan struct{}
 }
 
-func runtime() {
-	for {
-		switch itm := <-stream; itm.op {
-		case read:
-			result, ok := sessionStore[itm.token]
-			if ok {
-				itm.session = &result
-			}
-			itm.feedback <- ok
-		case write:
-			sessionStore[itm.token] = *itm.session
-			itm.feedback <- true
-		case gc:
-			garbageCollector(time.Now().Unix())
-		}
+//Option configures Manager
+type Option func(*Manager)
+
+//WithGCInterval sets interval of expired sessions collecting
+func WithGCInterval(interval time.Duration) Option {
+	return func(m *Manager) {
+		m.interval = interval
 	}
 }
 
-func scheduler(interval int) chan bool {
-	notifier := make(chan bool)
-	go func() {
-		for range time.Tick(time.Duration(interval) * time.Second) {
-			stream <- &sessionItem{
-				op: gc,
-			}
+//WithClock sets source of current time
+func WithClock(now func() time.Time) Option {
+	return func(m *Manager) {
+		m.now = now
+	}
+}
 
-			flush()
-			notifier <- true
-		}
-	}()
-	return notifier
+//WithSessionStore sets store of sessions. In-memory store is used by default
+func WithSessionStore(s SessionStore) Option {
+	return func(m *Manager) {
+		m.store = s
+	}
+}
+
+//WithSessionLimit limits number of active sessions of a user. Zero limit means no limit
+func WithSessionLimit(limit int, policy LimitPolicy) Option {
+	return func(m *Manager) {
+		m.limit = limit
+		m.limitPolicy = policy
+	}
+}
+
+//WithIdleTimeout ends sessions which were not refreshed during timeout, even if their renew tokens
+//would be valid longer. Zero timeout means sessions never idle out
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(m *Manager) {
+		m.idleTimeout = timeout
+	}
+}
+
+//WithSlidingExpiration limits how far refreshes extend sessions: each refresh extends the session by lifetime
+//of the new renew token, but not beyond maxLifetime since login. Zero maxLifetime means sessions are extended
+//without limit, which is the default
+func WithSlidingExpiration(maxLifetime time.Duration) Option {
+	return func(m *Manager) {
+		m.fixed = false
+		m.maxLifetime = maxLifetime
+	}
+}
+
+//WithFixedExpiration makes sessions end when their first renew token expires, refreshes don't extend them
+func WithFixedExpiration() Option {
+	return func(m *Manager) {
+		m.fixed = true
+	}
 }
 
-func garbageCollector(now int64) {
-	for token, session := range sessionStore {
-		if session.expireAt < now {
-			delete(sessionStore, token)
+//WithBindingPolicy sets what happens when session is refreshed by another client. Mismatches are allowed by default
+func WithBindingPolicy(policy BindingPolicy) Option {
+	return func(m *Manager) {
+		m.bindingPolicy = policy
+	}
+}
+
+//WithWriteLatency sets how long default in-memory store waits for more sessions before committing a batch
+func WithWriteLatency(latency time.Duration) Option {
+	return func(m *Manager) {
+		m.writeLatency = latency
+	}
+}
+
+//WithStore sets persistent store of default in-memory store
+func WithStore(s Persistent) Option {
+	return func(m *Manager) {
+		m.persistent = s
+	}
+}
+
+//NewManager creates sessions manager. By default it collects garbage every minute and keeps
+//sessions in memory persisting them into bolt
+func NewManager(options ...Option) *Manager {
+	m := &Manager{
+		interval:      time.Minute,
+		now:           time.Now,
+		writeLatency:  5 * time.Millisecond,
+		persistent:    BoltStore{},
+		bindingPolicy: AllowClientMismatch,
+		events:        make(chan Event, eventsBuffer),
+		subscribers:   make(map[int]func(Event)),
+		notifier:      make(chan bool),
+	}
+	for _, option := range options {
+		option(m)
+	}
+	if m.store == nil {
+		m.store = NewMemoryStore(m.persistent, m.writeLatency, m.now)
+	}
+	return m
+}
+
+//Start runs sessions runtime until Stop is called or ctx is done
+func (m *Manager) Start(ctx context.Context) {
+	ctx, m.cancel = context.WithCancel(ctx)
+	m.done = make(chan struct{})
+	m.dispatched = make(chan struct{})
+
+	if s, ok := m.store.(starter); ok {
+		s.start()
+	}
+	go m.scheduler(ctx)
+	go m.dispatcher(ctx)
+}
+
+//Stop stops runtime if it was started and closes the store. Manager can't be used after Stop
+func (m *Manager) Stop() {
+	if m.cancel != nil {
+		m.cancel()
+		<-m.done
+		<-m.dispatched
+	}
+
+	if c, ok := m.store.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Println("Error while closing session store: ", err.Error())
 		}
 	}
 }
 
-func flush() {
-	now := time.Now().Unix()
-	for _, itm := range flushStream {
-		if now < itm.session.expireAt {
-			store.AddRenewToken(itm.token, itm.session.expireAt)
+//OnCollect registers hook called by scheduler after each collection of expired sessions,
+//so other expiring data can be purged on the same interval
+func (m *Manager) OnCollect(hook func(now int64)) {
+	m.collectHooksMutex.Lock()
+	defer m.collectHooksMutex.Unlock()
+
+	m.collectHooks = append(m.collectHooks[:len(m.collectHooks):len(m.collectHooks)], hook)
+}
+
+func (m *Manager) scheduler(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			expired, err := m.store.Collect(m.now().Unix())
+			if err != nil {
+				log.Println("Error while collecting sessions: ", err.Error())
+			}
+			for _, s := range expired {
+				m.emit(SessionExpired, s, "")
+			}
+			m.collectHooksMutex.Lock()
+			hooks := m.collectHooks
+			m.collectHooksMutex.Unlock()
+			for _, hook := range hooks {
+				hook(m.now().Unix())
+			}
+
+			select {
+			case m.notifier <- true:
+			default:
+			}
+		case <-ctx.Done():
+			close(m.done)
+			return
 		}
 	}
-	flushStream = make([]sessionItem, 0)
 }
 
-//Create cunstructor for session struct
-func Create(email string, expireAt int64) *Session {
+//Create cunstructor for session struct of the user with the ID. Session expires at expireAt or earlier
+//if maximum lifetime or idle timeout is shorter, callers issue renew token till ExpireAt
+func (m *Manager) Create(userID string, email string, family string, expireAt int64) *Session {
 	var s Session
+	s.userID = userID
 	s.emial = email
-	s.expireAt = expireAt
+	s.family = family
+	s.createdAt = m.now().Unix()
+	s.maxExpireAt = m.lifetimeLimit(s.createdAt, expireAt)
+	s.expireAt = m.idleLimit(s.createdAt, s.maxExpireAt)
 	return &s
 }
 
-//Add puts toket into session
-func (s *Session) Add(token string) bool {
-	itm := sessionItem{
-		session:  s,
-		token:    token,
-		op:       write,
-		feedback: make(chan bool, 1),
+//Rotate creates session of the next renew token of the family. Client data and creation time are kept.
+//Session is extended till expireAt unless expiration is fixed
+func (m *Manager) Rotate(s *Session, expireAt int64) *Session {
+	next := *s
+	next.retired = false
+	next.refreshedAt = m.now().Unix()
+	if next.maxExpireAt == 0 {
+		next.maxExpireAt = s.expireAt
+	}
+	if !m.fixed {
+		next.maxExpireAt = m.lifetimeLimit(s.createdAt, expireAt)
 	}
+	next.expireAt = m.idleLimit(next.refreshedAt, next.maxExpireAt)
+	return &next
+}
+
+//lifetimeLimit caps expireAt by maximum lifetime of sliding session created at createdAt
+func (m *Manager) lifetimeLimit(createdAt int64, expireAt int64) int64 {
+	if m.fixed || m.maxLifetime <= 0 {
+		return expireAt
+	}
+	if limit := createdAt + int64(m.maxLifetime/time.Second); limit < expireAt {
+		return limit
+	}
+	return expireAt
+}
 
-	stream <- &itm
-	if ok := <-itm.feedback; ok {
-		flushStream = append(flushStream, itm)
+//idleLimit caps maxExpireAt by idle timeout counted from the last use of the session
+func (m *Manager) idleLimit(usedAt int64, maxExpireAt int64) int64 {
+	if m.idleTimeout <= 0 {
+		return maxExpireAt
+	}
+	if limit := usedAt + int64(m.idleTimeout/time.Second); limit < maxExpireAt {
+		return limit
 	}
+	return maxExpireAt
+}
 
-	return true
+//SetClient records address and User-Agent of the client which started the session
+func (s *Session) SetClient(ip string, userAgent string) {
+	s.ip = ip
+	s.userAgent = userAgent
 }
 
-//Get get serssion form sessionStore
-func Get(token string) (bool, *Session) {
-	itm := sessionItem{
-		session:  nil,
-		token:    token,
-		op:       read,
-		feedback: make(chan bool, 1),
+//SetUserID sets owner of session started before sessions were keyed by user ID
+func (s *Session) SetUserID(userID string) {
+	s.userID = userID
+}
+
+//Restore creates session from persisted renew token
+func Restore(token *store.RenewToken) *Session {
+	var s Session
+	s.userID = token.UserID
+	s.emial = token.Email
+	s.family = token.Family
+	s.expireAt = token.ExpireAt
+	s.maxExpireAt = token.MaxExpireAt
+	s.retired = token.Retired
+	s.createdAt = token.CreatedAt
+	s.refreshedAt = token.RefreshedAt
+	s.ip = token.IP
+	s.userAgent = token.UserAgent
+	return &s
+}
+
+func (s *Session) renewToken(token string) store.RenewToken {
+	return store.RenewToken{
+		Digest:      token,
+		UserID:      s.userID,
+		Email:       s.emial,
+		Family:      s.family,
+		ExpireAt:    s.expireAt,
+		MaxExpireAt: s.maxExpireAt,
+		Retired:     s.retired,
+		CreatedAt:   s.createdAt,
+		RefreshedAt: s.refreshedAt,
+		IP:          s.ip,
+		UserAgent:   s.userAgent,
+	}
+}
+
+//Rehydrate loads all unexpired sessions from persistent store, if the session store keeps them in memory.
+//Returns number of loaded sessions
+func (m *Manager) Rehydrate() int {
+	if r, ok := m.store.(rehydrator); ok {
+		return r.rehydrate()
+	}
+	return 0
+}
+
+//UserID returns ID of session owner
+func (s *Session) UserID() string {
+	return s.userID
+}
+
+//Email returns email session owner had at login
+func (s *Session) Email() string {
+	return s.emial
+}
+
+//Family returns id of the renew tokens family
+func (s *Session) Family() string {
+	return s.family
+}
+
+//Retired reports if renew token was already exchanged
+func (s *Session) Retired() bool {
+	return s.retired
+}
+
+//ExpireAt returns expiration time of renew token
+func (s *Session) ExpireAt() int64 {
+	return s.expireAt
+}
+
+//MaxExpireAt returns time when the session ends even if it is used
+func (s *Session) MaxExpireAt() int64 {
+	return s.maxExpireAt
+}
+
+//CreatedAt returns time of login which started the session
+func (s *Session) CreatedAt() int64 {
+	return s.createdAt
+}
+
+//RefreshedAt returns time of the last renew token exchange, zero if it was never exchanged
+func (s *Session) RefreshedAt() int64 {
+	return s.refreshedAt
+}
+
+//IP returns address of the client which started the session
+func (s *Session) IP() string {
+	return s.ip
+}
+
+//UserAgent returns User-Agent of the client which started the session
+func (s *Session) UserAgent() string {
+	return s.userAgent
+}
+
+//Add puts toket into session. Token is stored as is, callers put digests of renew tokens.
+//Session is written into the store before Add returns, so it survives restarts.
+//Session made by Rotate is reported as refreshed, others as created. Returns error if session
+//wasn't written, its token must not be handed out then
+func (m *Manager) Add(token string, s *Session) error {
+	if err := m.store.Put(token, s); err != nil {
+		log.Println("Error while writing session: ", err.Error())
+		return err
 	}
 
-	stream <- &itm
-	if ok := <-itm.feedback; !ok {
+	if s.refreshedAt == 0 {
+		m.emit(SessionCreated, s, "")
+	} else {
+		m.emit(SessionRefreshed, s, "")
+	}
+	return nil
+}
+
+//Open adds session started by login. If the user has the maximum of active sessions,
+//new session is rejected with ErrSessionLimit or the oldest sessions are evicted according limit policy.
+//Returns evicted sessions
+func (m *Manager) Open(token string, s *Session) ([]*Session, error) {
+	if m.limit <= 0 {
+		return nil, m.Add(token, s)
+	}
+
+	m.openMutex.Lock()
+	defer m.openMutex.Unlock()
+
+	active, err := m.UserSessions(s.userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var evicted []*Session
+	for ; len(active) >= m.limit; active = active[1:] {
+		if m.limitPolicy != EvictOldestSession {
+			return nil, ErrSessionLimit
+		}
+		if err := m.Revoke(active[0], RevokedByEviction); err != nil {
+			return evicted, err
+		}
+		evicted = append(evicted, active[0])
+	}
+
+	return evicted, m.Add(token, s)
+}
+
+//Get get serssion form sessionStore
+func (m *Manager) Get(token string) (bool, *Session) {
+	s, err := m.store.Get(token)
+	if err != nil {
+		log.Println("Error while reading session: ", err.Error())
 		return false, nil
 	}
+	return s != nil, s
+}
+
+//Delete removes token from sessionStore
+func (m *Manager) Delete(token string) error {
+	return m.store.Delete(token)
+}
+
+//Retire marks token as exchanged. Returns false if token is unknown or already retired
+func (m *Manager) Retire(token string) (bool, error) {
+	return m.store.Retire(token)
+}
+
+//Revoke removes all tokens of the session family from sessionStore
+func (m *Manager) Revoke(s *Session, reason string) error {
+	if err := m.store.DeleteFamily(s.family); err != nil {
+		return err
+	}
 
-	return true, itm.session
+	m.emit(SessionRevoked, s, reason)
+	return nil
+}
+
+//RevokeUser removes all sessions of the user with the ID
+func (m *Manager) RevokeUser(userID string, reason string) error {
+	active, err := m.UserSessions(userID)
+	if err != nil {
+		return err
+	}
+	if err := m.store.DeleteUser(userID); err != nil {
+		return err
+	}
+
+	for _, s := range active {
+		m.emit(SessionRevoked, s, reason)
+	}
+	return nil
+}
+
+//RevokeToken rejects auth token with the ID till its expiration at expireAt
+func (m *Manager) RevokeToken(id string, expireAt int64) error {
+	return m.store.RevokeToken(id, expireAt)
+}
+
+//IsTokenRevoked checks if auth token with the ID was revoked
+func (m *Manager) IsTokenRevoked(id string) (bool, error) {
+	return m.store.IsTokenRevoked(id)
+}
+
+//UserSessions returns active sessions of the user with the ID, one per renew tokens family, oldest first
+func (m *Manager) UserSessions(userID string) ([]*Session, error) {
+	tokens, err := m.store.UserSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := m.now().Unix()
+	result := make([]*Session, 0, len(tokens))
+	for _, s := range tokens {
+		if !s.retired && now < s.expireAt {
+			result = append(result, s)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].createdAt == result[j].createdAt {
+			return result[i].family < result[j].family
+		}
+		return result[i].createdAt < result[j].createdAt
+	})
+	return result, nil
 }
@@ -1,9 +1,16 @@
 package session
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"go-auth/src/store"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -17,19 +24,19 @@ func init() {
 }
 
 func TestAddTokenToSession(t *testing.T) {
-	sessionStore = make(map[string]Session)
-	flushStream = flushStream[:0]
+	m := startManager()
+	defer m.Stop()
 
 	test := func(n int) {
 		token := fmt.Sprintf("some_token_%v", n)
 		expireAt := time.Now().Add(2 * time.Second).Unix()
 
-		session := Create("test@test.com", expireAt)
-		added := session.Add(token)
+		session := m.Create("test_user", "test@test.com", "test_family", expireAt)
+		err := m.Add(token, session)
 
-		assert.True(t, added)
+		assert.Nil(t, err)
 
-		exists, _ := Get(token)
+		exists, _ := m.Get(token)
 		assert.True(t, exists)
 	}
 
@@ -45,13 +52,13 @@ func TestAddTokenToSession(t *testing.T) {
 }
 
 func TestGetTokensFromSession(t *testing.T) {
-	sessionStore = make(map[string]Session)
-	flushStream = flushStream[:0]
+	m := startManager()
+	defer m.Stop()
 
 	test := func(n int) {
 		token := fmt.Sprintf("some_token_%v", n)
 
-		ok, s := Get(token)
+		ok, s := m.Get(token)
 
 		assert.True(t, ok)
 		assert.Equal(t, "test@test.com", s.emial)
@@ -60,8 +67,8 @@ func TestGetTokensFromSession(t *testing.T) {
 	for i := 0; i < 1000; i++ {
 		token := fmt.Sprintf("some_token_%v", i)
 
-		session := Create("test@test.com", time.Now().Add(2*time.Second).Unix())
-		session.Add(token)
+		session := m.Create("test_user", "test@test.com", "test_family", time.Now().Add(2*time.Second).Unix())
+		m.Add(token, session)
 	}
 
 	var wg sync.WaitGroup
@@ -76,98 +83,102 @@ func TestGetTokensFromSession(t *testing.T) {
 }
 
 func TestGetInvalidTokenFromSession(t *testing.T) {
-	sessionStore = make(map[string]Session)
-	flushStream = flushStream[:0]
+	m := startManager()
+	defer m.Stop()
 
 	for i := 0; i < 5; i++ {
 		token := fmt.Sprintf("some_token_%v", i)
 
-		session := Create("test@test.com", time.Now().Add(2*time.Second).Unix())
-		session.Add(token)
+		session := m.Create("test_user", "test@test.com", "test_family", time.Now().Add(2*time.Second).Unix())
+		m.Add(token, session)
 	}
 
 	token := "some_invalid_token"
 
-	ok, s := Get(token)
+	ok, s := m.Get(token)
 
 	assert.False(t, ok)
 	assert.Nil(t, s)
 }
 
 func TestGC(t *testing.T) {
-	sessionStore = make(map[string]Session)
-	flushStream = flushStream[:0]
+	m := startManager()
+	defer m.Stop()
 
 	for i := 0; i < 3; i++ {
 		token := fmt.Sprintf("some_token_%v", i)
 
-		session := Create("test@test.com", time.Now().Add(2*time.Minute).Unix())
-		session.Add(token)
+		session := m.Create("test_user", "test@test.com", "test_family", time.Now().Add(2*time.Minute).Unix())
+		m.Add(token, session)
 	}
 	for i := 3; i < 5; i++ {
 		token := fmt.Sprintf("some_token_%v", i)
 
-		session := Create("test@test.com", 0)
-		session.Add(token)
+		session := m.Create("test_user", "test@test.com", "test_family", 0)
+		m.Add(token, session)
 	}
 	for i := 5; i < 7; i++ {
 		token := fmt.Sprintf("some_token_%v", i)
 
-		session := Create("test@test.com", time.Now().Add(2*time.Minute).Unix())
-		session.Add(token)
+		session := m.Create("test_user", "test@test.com", "test_family", time.Now().Add(2*time.Minute).Unix())
+		m.Add(token, session)
 	}
 
-	garbageCollector(time.Now().Unix())
+	memory := m.store.(*MemoryStore)
+	memory.garbageCollector(time.Now().Unix())
+	stored := storedSessions(memory)
 
-	assert.Contains(t, sessionStore, "some_token_0")
-	assert.Contains(t, sessionStore, "some_token_1")
-	assert.Contains(t, sessionStore, "some_token_2")
+	assert.Contains(t, stored, "some_token_0")
+	assert.Contains(t, stored, "some_token_1")
+	assert.Contains(t, stored, "some_token_2")
 
-	assert.NotContains(t, sessionStore, "some_token_3")
-	assert.NotContains(t, sessionStore, "some_token_4")
+	assert.NotContains(t, stored, "some_token_3")
+	assert.NotContains(t, stored, "some_token_4")
 
-	assert.Contains(t, sessionStore, "some_token_5")
-	assert.Contains(t, sessionStore, "some_token_6")
+	assert.Contains(t, stored, "some_token_5")
+	assert.Contains(t, stored, "some_token_6")
 }
 
 func TestScheduler(t *testing.T) {
-	sessionStore = make(map[string]Session)
-	flushStream = flushStream[:0]
+	m := startManager(WithGCInterval(time.Second))
+	defer m.Stop()
 
 	prepareBolt(t)
+	var collectedAt int64
+	m.OnCollect(func(now int64) { atomic.StoreInt64(&collectedAt, now) })
 
 	for i := 0; i < 3; i++ {
 		token := fmt.Sprintf("some_token_%v", i)
 
-		session := Create("test@test.com", time.Now().Add(2*time.Minute).Unix())
-		session.Add(token)
+		session := m.Create("test_user", "test@test.com", "test_family", time.Now().Add(2*time.Minute).Unix())
+		m.Add(token, session)
 	}
 	for i := 3; i < 5; i++ {
 		token := fmt.Sprintf("some_token_%v", i)
 
-		session := Create("test@test.com", 0)
-		session.Add(token)
+		session := m.Create("test_user", "test@test.com", "test_family", 0)
+		m.Add(token, session)
 	}
 	for i := 5; i < 7; i++ {
 		token := fmt.Sprintf("some_token_%v", i)
 
-		session := Create("test@test.com", time.Now().Add(2*time.Minute).Unix())
-		session.Add(token)
+		session := m.Create("test_user", "test@test.com", "test_family", time.Now().Add(2*time.Minute).Unix())
+		m.Add(token, session)
 	}
 
-	notif := scheduler(1)
+	assert.True(t, <-m.notifier)
+	assert.NotZero(t, atomic.LoadInt64(&collectedAt))
 
-	assert.True(t, <-notif)
+	stored := storedSessions(m.store.(*MemoryStore))
+	assert.Contains(t, stored, "some_token_0")
+	assert.Contains(t, stored, "some_token_1")
+	assert.Contains(t, stored, "some_token_2")
 
-	assert.Contains(t, sessionStore, "some_token_0")
-	assert.Contains(t, sessionStore, "some_token_1")
-	assert.Contains(t, sessionStore, "some_token_2")
+	assert.NotContains(t, stored, "some_token_3")
+	assert.NotContains(t, stored, "some_token_4")
 
-	assert.NotContains(t, sessionStore, "some_token_3")
-	assert.NotContains(t, sessionStore, "some_token_4")
-
-	assert.Contains(t, sessionStore, "some_token_5")
-	assert.Contains(t, sessionStore, "some_token_6")
+	assert.Contains(t, stored, "some_token_5")
+	assert.Contains(t, stored, "some_token_6")
 
 	tokens := store.GetAllRenewTokens()
 
@@ -175,26 +186,42 @@ func TestScheduler(t *testing.T) {
 
 }
 
-func TestFlushToPersistentStorage(t *testing.T) {
-	sessionStore = make(map[string]Session)
-	flushStream = make([]sessionItem, 0)
+func TestWriteToPersistentStorage(t *testing.T) {
+	m := startManager()
+	defer m.Stop()
 
 	prepareBolt(t)
 
 	for i := 0; i < 5; i++ {
 		token := fmt.Sprintf("some_token_%v", i)
 
-		session := Create("test@test.com", time.Now().Add(2*time.Minute).Unix())
-		session.Add(token)
+		session := m.Create("test_user", "test@test.com", "test_family", time.Now().Add(2*time.Minute).Unix())
+		m.Add(token, session)
 	}
 
-	flush()
-
 	tokens := store.GetAllRenewTokens()
 
 	assert.Equal(t, 5, len(tokens))
 }
 
+func startManager(options ...Option) *Manager {
+	m := NewManager(options...)
+	m.Start(context.Background())
+	return m
+}
+
+func storedSessions(m *MemoryStore) map[string]Session {
+	stored := make(map[string]Session)
+	for _, s := range m.shards {
+		s.RLock()
+		for token, session := range s.sessions {
+			stored[token] = session
+		}
+		s.RUnlock()
+	}
+	return stored
+}
+
 func prepareBolt(t *testing.T) {
 	if err := store.DropDatabase(); err != nil {
 		t.FailNow()
@@ -203,3 +230,1081 @@ func prepareBolt(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestRetireToken(t *testing.T) {
+	m := startManager()
+	defer m.Stop()
+
+	session := m.Create("test_user", "test@test.com", "test_family", time.Now().Add(2*time.Minute).Unix())
+	m.Add("some_token", session)
+
+	retired, err := m.Retire("some_token")
+	assert.Nil(t, err)
+	assert.True(t, retired)
+	retired, _ = m.Retire("some_token")
+	assert.False(t, retired)
+	retired, _ = m.Retire("some_invalid_token")
+	assert.False(t, retired)
+
+	ok, s := m.Get("some_token")
+	assert.True(t, ok)
+	assert.True(t, s.Retired())
+}
+
+func TestDeleteFamily(t *testing.T) {
+	m := startManager()
+	defer m.Stop()
+
+	for i := 0; i < 3; i++ {
+		session := m.Create("test_user", "test@test.com", "test_family", time.Now().Add(2*time.Minute).Unix())
+		m.Add(fmt.Sprintf("some_token_%v", i), session)
+	}
+	session := m.Create("test_user", "test@test.com", "another_family", time.Now().Add(2*time.Minute).Unix())
+	m.Add("another_token", session)
+
+	assert.Nil(t, m.Revoke(m.Create("test_user", "test@test.com", "test_family", 0), RevokedByLogout))
+
+	stored := storedSessions(m.store.(*MemoryStore))
+	assert.Len(t, stored, 1)
+	assert.Contains(t, stored, "another_token")
+	active, _ := m.UserSessions("test_user")
+	assert.Len(t, active, 1)
+	for _, shard := range m.store.(*MemoryStore).shards {
+		assert.NotContains(t, shard.familyIndex, "test_family")
+	}
+}
+
+func TestRehydrate(t *testing.T) {
+	m := startManager()
+	defer m.Stop()
+
+	prepareBolt(t)
+
+	store.AddRenewToken(store.RenewToken{
+		Digest:   "some_token_0",
+		UserID:   "test_user",
+		Email:    "test@test.com",
+		Family:   "test_family",
+		ExpireAt: time.Now().Add(2 * time.Minute).Unix(),
+	})
+	store.AddRenewToken(store.RenewToken{
+		Digest:   "some_token_1",
+		Email:    "test@test.com",
+		Family:   "test_family",
+		ExpireAt: time.Now().Add(2 * time.Minute).Unix(),
+		Retired:  true,
+	})
+	store.AddRenewToken(store.RenewToken{
+		Digest:   "some_token_2",
+		Email:    "test@test.com",
+		ExpireAt: time.Now().Add(-2 * time.Minute).Unix(),
+	})
+
+	assert.Equal(t, 2, m.Rehydrate())
+
+	ok, s := m.Get("some_token_0")
+	assert.True(t, ok)
+	assert.Equal(t, "test_user", s.UserID())
+	assert.Equal(t, "test@test.com", s.Email())
+	assert.Equal(t, "test_family", s.Family())
+	assert.False(t, s.Retired())
+
+	ok, s = m.Get("some_token_1")
+	assert.True(t, ok)
+	assert.True(t, s.Retired())
+
+	ok, _ = m.Get("some_token_2")
+	assert.False(t, ok)
+}
+
+type countingStore struct {
+	mutex   sync.Mutex
+	batches int
+	tokens  []store.RenewToken
+	err     error
+}
+
+func (s *countingStore) AddRenewTokens(tokens []store.RenewToken) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.batches++
+	if s.err == nil {
+		s.tokens = append(s.tokens, tokens...)
+	}
+	return s.err
+}
+
+func (s *countingStore) GetAllRenewTokens() []store.RenewToken {
+	return s.tokens
+}
+
+func (s *countingStore) GetRenewToken(digest string) (bool, *store.RenewToken) {
+	return false, nil
+}
+
+func (s *countingStore) RetireRenewToken(digest string) (bool, error) {
+	return false, nil
+}
+
+func (s *countingStore) DeleteRenewToken(digest string) error {
+	return nil
+}
+
+func (s *countingStore) DeleteRenewFamily(family string) error {
+	return nil
+}
+
+func (s *countingStore) DeleteUserRenewTokens(userID string) error {
+	return nil
+}
+
+func (s *countingStore) ClearRenewTokens(now int64) ([]store.RenewToken, error) {
+	return nil, nil
+}
+
+func (s *countingStore) AddRevokedToken(id string, expireAt int64) error {
+	return nil
+}
+
+func (s *countingStore) IsTokenRevoked(id string) (bool, error) {
+	return false, nil
+}
+
+func (s *countingStore) ClearRevokedTokens(now int64) error {
+	return nil
+}
+
+func TestMemoryStore_WithoutWriter(t *testing.T) {
+	persistent := &countingStore{}
+	m := NewManager(WithStore(persistent))
+
+	assert.Nil(t, m.Add("some_token", m.Create("test_user", "test@test.com", "test_family", time.Now().Add(time.Minute).Unix())))
+	assert.Len(t, persistent.tokens, 1, "session is written directly before start")
+	m.Stop()
+
+	assert.Nil(t, m.Add("other_token", m.Create("test_user", "test@test.com", "other_family", time.Now().Add(time.Minute).Unix())))
+	assert.Len(t, persistent.tokens, 2, "session is written directly after stop")
+}
+
+func TestManager_StopTwice(t *testing.T) {
+	m := startManager(WithStore(&countingStore{}))
+	m.Stop()
+	m.Stop()
+}
+
+func TestWriteInBatches(t *testing.T) {
+	persistent := &countingStore{}
+	m := startManager(WithStore(persistent), WithWriteLatency(20*time.Millisecond))
+	defer m.Stop()
+
+	var wg sync.WaitGroup
+	wg.Add(1000)
+	for i := 0; i < 1000; i++ {
+		go func(n int) {
+			session := m.Create("test_user", "test@test.com", "test_family", time.Now().Add(2*time.Minute).Unix())
+			assert.Nil(t, m.Add(fmt.Sprintf("some_token_%v", n), session))
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Len(t, persistent.tokens, 1000)
+	assert.True(t, persistent.batches < 1000)
+}
+
+func TestWriteFailure(t *testing.T) {
+	persistent := &countingStore{err: errors.New("disk is full")}
+	m := startManager(WithStore(persistent))
+	defer m.Stop()
+
+	session := m.Create("test_user", "test@test.com", "test_family", time.Now().Add(2*time.Minute).Unix())
+	assert.NotNil(t, m.Add("some_token", session))
+
+	ok, _ := m.Get("some_token")
+	assert.False(t, ok)
+}
+
+func TestManagerStop(t *testing.T) {
+	prepareBolt(t)
+
+	m := startManager(WithGCInterval(time.Hour))
+
+	session := m.Create("test_user", "test@test.com", "test_family", time.Now().Add(2*time.Minute).Unix())
+	m.Add("some_token", session)
+
+	m.Stop()
+
+	tokens := store.GetAllRenewTokens()
+	assert.Len(t, tokens, 1)
+	assert.Equal(t, "some_token", tokens[0].Digest)
+}
+
+func TestManagerClock(t *testing.T) {
+	now := time.Now().Add(time.Hour)
+	m := startManager(WithClock(func() time.Time { return now }), WithStore(&countingStore{}))
+	defer m.Stop()
+
+	session := m.Create("test_user", "test@test.com", "test_family", time.Now().Add(2*time.Minute).Unix())
+	m.Add("some_token", session)
+
+	m.store.Collect(now.Unix())
+
+	ok, _ := m.Get("some_token")
+	assert.False(t, ok)
+}
+
+func TestManagersAreIsolated(t *testing.T) {
+	first := startManager(WithStore(&countingStore{}))
+	defer first.Stop()
+	second := startManager(WithStore(&countingStore{}))
+	defer second.Stop()
+
+	session := first.Create("test_user", "test@test.com", "test_family", time.Now().Add(2*time.Minute).Unix())
+	first.Add("some_token", session)
+
+	ok, _ := first.Get("some_token")
+	assert.True(t, ok)
+
+	ok, _ = second.Get("some_token")
+	assert.False(t, ok)
+}
+
+//redisStandIn is an in-process server which speaks enough of Redis protocol for RedisStore
+type redisStandIn struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	values   map[string]string
+	sets     map[string]map[string]bool
+	zsets    map[string]map[string]float64
+	expireAt map[string]time.Time
+}
+
+func startRedisStandIn(t *testing.T) *redisStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &redisStandIn{
+		listener: listener,
+		values:   make(map[string]string),
+		sets:     make(map[string]map[string]bool),
+		zsets:    make(map[string]map[string]float64),
+		expireAt: make(map[string]time.Time),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *redisStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	//queued holds commands of open MULTI transaction
+	var queued [][]string
+	for {
+		command, err := c.read()
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range command.([]interface{}) {
+			args = append(args, arg.(string))
+		}
+
+		switch {
+		case strings.EqualFold(args[0], "MULTI"):
+			queued = [][]string{}
+			conn.Write([]byte("+OK\r\n"))
+		case strings.EqualFold(args[0], "EXEC") && queued != nil:
+			conn.Write(r.exec(queued))
+			queued = nil
+		case queued != nil:
+			queued = append(queued, args)
+			conn.Write([]byte("+QUEUED\r\n"))
+		default:
+			conn.Write(r.execute(args))
+		}
+	}
+}
+
+//exec runs transaction commands under one lock and replies with array of their replies
+func (r *redisStandIn) exec(commands [][]string) []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	reply := []byte(fmt.Sprintf("*%d\r\n", len(commands)))
+	for _, args := range commands {
+		reply = append(reply, r.executeLocked(args)...)
+	}
+	return reply
+}
+
+func (r *redisStandIn) expire(key string) {
+	if at, ok := r.expireAt[key]; ok && !time.Now().Before(at) {
+		delete(r.values, key)
+		delete(r.sets, key)
+		delete(r.zsets, key)
+		delete(r.expireAt, key)
+	}
+}
+
+//exists reports whether key holds value of any type
+func (r *redisStandIn) exists(key string) bool {
+	_, value := r.values[key]
+	_, set := r.sets[key]
+	_, zset := r.zsets[key]
+	return value || set || zset
+}
+
+//scoreRange parses score bounds of sorted set commands. Bound starting with ( is exclusive
+func scoreRange(min string, max string) func(score float64) bool {
+	bound := func(arg string) (float64, bool) {
+		exclusive := strings.HasPrefix(arg, "(")
+		arg = strings.TrimPrefix(arg, "(")
+		value, _ := strconv.ParseFloat(strings.TrimPrefix(arg, "+"), 64)
+		return value, exclusive
+	}
+	lower, lowerExclusive := bound(min)
+	upper, upperExclusive := bound(max)
+	return func(score float64) bool {
+		if score < lower || lowerExclusive && score == lower {
+			return false
+		}
+		return score < upper || !upperExclusive && score == upper
+	}
+}
+
+func (r *redisStandIn) execute(args []string) []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.executeLocked(args)
+}
+
+func (r *redisStandIn) executeLocked(args []string) []byte {
+	for _, key := range args[1:] {
+		r.expire(key)
+	}
+
+	bulk := func(key string) string {
+		if value, ok := r.values[key]; ok {
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+		}
+		return "$-1\r\n"
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		return []byte(bulk(args[1]))
+	case "MGET":
+		reply := fmt.Sprintf("*%d\r\n", len(args)-1)
+		for _, key := range args[1:] {
+			reply += bulk(key)
+		}
+		return []byte(reply)
+	case "SET":
+		key, nx := args[1], false
+		var ttl time.Duration
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "EX":
+				seconds, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(seconds) * time.Second
+				i++
+			}
+		}
+		if _, exists := r.values[key]; nx && exists {
+			return []byte("$-1\r\n")
+		}
+		r.values[key] = args[2]
+		delete(r.expireAt, key)
+		if ttl > 0 {
+			r.expireAt[key] = time.Now().Add(ttl)
+		}
+		return []byte("+OK\r\n")
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if r.exists(key) {
+				deleted++
+			}
+			delete(r.values, key)
+			delete(r.sets, key)
+			delete(r.zsets, key)
+			delete(r.expireAt, key)
+		}
+		return []byte(fmt.Sprintf(":%d\r\n", deleted))
+	case "SADD":
+		if r.sets[args[1]] == nil {
+			r.sets[args[1]] = make(map[string]bool)
+		}
+		for _, member := range args[2:] {
+			r.sets[args[1]][member] = true
+		}
+		return []byte(fmt.Sprintf(":%d\r\n", len(args)-2))
+	case "SMEMBERS":
+		reply := fmt.Sprintf("*%d\r\n", len(r.sets[args[1]]))
+		for member := range r.sets[args[1]] {
+			reply += fmt.Sprintf("$%d\r\n%s\r\n", len(member), member)
+		}
+		return []byte(reply)
+	case "SREM":
+		removed := 0
+		for _, member := range args[2:] {
+			if r.sets[args[1]][member] {
+				delete(r.sets[args[1]], member)
+				removed++
+			}
+		}
+		if len(r.sets[args[1]]) == 0 {
+			delete(r.sets, args[1])
+		}
+		return []byte(fmt.Sprintf(":%d\r\n", removed))
+	case "ZADD":
+		if r.zsets[args[1]] == nil {
+			r.zsets[args[1]] = make(map[string]float64)
+		}
+		added := 0
+		for i := 2; i+1 < len(args); i += 2 {
+			if _, ok := r.zsets[args[1]][args[i+1]]; !ok {
+				added++
+			}
+			r.zsets[args[1]][args[i+1]], _ = strconv.ParseFloat(args[i], 64)
+		}
+		return []byte(fmt.Sprintf(":%d\r\n", added))
+	case "ZRANGE", "ZRANGEBYSCORE":
+		inRange := func(score float64) bool { return true }
+		if strings.ToUpper(args[0]) == "ZRANGEBYSCORE" {
+			inRange = scoreRange(args[2], args[3])
+		}
+		var members []string
+		for member, score := range r.zsets[args[1]] {
+			if inRange(score) {
+				members = append(members, member)
+			}
+		}
+		reply := fmt.Sprintf("*%d\r\n", len(members))
+		for _, member := range members {
+			reply += fmt.Sprintf("$%d\r\n%s\r\n", len(member), member)
+		}
+		return []byte(reply)
+	case "ZREM", "ZREMRANGEBYSCORE":
+		match := func(member string, score float64) bool {
+			for _, arg := range args[2:] {
+				if arg == member {
+					return true
+				}
+			}
+			return false
+		}
+		if strings.ToUpper(args[0]) == "ZREMRANGEBYSCORE" {
+			inRange := scoreRange(args[2], args[3])
+			match = func(member string, score float64) bool { return inRange(score) }
+		}
+		removed := 0
+		for member, score := range r.zsets[args[1]] {
+			if match(member, score) {
+				delete(r.zsets[args[1]], member)
+				removed++
+			}
+		}
+		if len(r.zsets[args[1]]) == 0 {
+			delete(r.zsets, args[1])
+			delete(r.expireAt, args[1])
+		}
+		return []byte(fmt.Sprintf(":%d\r\n", removed))
+	case "EXPIRE":
+		if !r.exists(args[1]) {
+			return []byte(":0\r\n")
+		}
+		seconds, _ := strconv.Atoi(args[2])
+		at := time.Now().Add(time.Duration(seconds) * time.Second)
+		current, hasTTL := r.expireAt[args[1]]
+		if len(args) > 3 {
+			switch strings.ToUpper(args[3]) {
+			case "NX":
+				if hasTTL {
+					return []byte(":0\r\n")
+				}
+			case "GT":
+				//Key without TTL lives forever, so GT never changes it
+				if !hasTTL || !at.After(current) {
+					return []byte(":0\r\n")
+				}
+			}
+		}
+		r.expireAt[args[1]] = at
+		return []byte(":1\r\n")
+	case "TTL":
+		if !r.exists(args[1]) {
+			return []byte(":-2\r\n")
+		}
+		at, ok := r.expireAt[args[1]]
+		if !ok {
+			return []byte(":-1\r\n")
+		}
+		return []byte(fmt.Sprintf(":%d\r\n", int64(time.Until(at)/time.Second)))
+	}
+	return []byte("-ERR unknown command '" + args[0] + "'\r\n")
+}
+
+func TestSessionStores(t *testing.T) {
+	redis := startRedisStandIn(t)
+	defer redis.listener.Close()
+
+	stores := map[string]SessionStore{
+		"memory": NewMemoryStore(BoltStore{}, time.Millisecond, time.Now),
+		"bolt":   BoltStore{},
+		"redis":  NewRedisStore(redis.listener.Addr().String()),
+	}
+
+	for name, sessionStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			prepareBolt(t)
+			m := startManager(WithSessionStore(sessionStore))
+			defer m.Stop()
+
+			expireAt := time.Now().Add(2 * time.Minute).Unix()
+			for i := 0; i < 3; i++ {
+				assert.Nil(t, m.Add(fmt.Sprintf("some_token_%v", i), m.Create("test_user", "test@test.com", "test_family", expireAt)))
+			}
+			assert.Nil(t, m.Add("another_token", m.Create("test_user", "test@test.com", "another_family", expireAt)))
+
+			ok, s := m.Get("some_token_0")
+			assert.True(t, ok)
+			assert.Equal(t, "test@test.com", s.Email())
+			assert.Equal(t, "test_family", s.Family())
+			assert.False(t, s.Retired())
+
+			ok, _ = m.Get("some_invalid_token")
+			assert.False(t, ok)
+
+			retired, err := m.Retire("some_token_0")
+			assert.Nil(t, err)
+			assert.True(t, retired)
+			retired, _ = m.Retire("some_token_0")
+			assert.False(t, retired)
+			retired, _ = m.Retire("some_invalid_token")
+			assert.False(t, retired)
+
+			ok, s = m.Get("some_token_0")
+			assert.True(t, ok)
+			assert.True(t, s.Retired())
+
+			assert.Nil(t, m.Delete("some_token_1"))
+			ok, _ = m.Get("some_token_1")
+			assert.False(t, ok)
+
+			assert.Nil(t, m.Revoke(s, RevokedByLogout))
+			ok, _ = m.Get("some_token_2")
+			assert.False(t, ok)
+			ok, _ = m.Get("another_token")
+			assert.True(t, ok)
+
+			assert.Nil(t, m.RevokeToken("some_jti", expireAt))
+			revoked, err := m.IsTokenRevoked("some_jti")
+			assert.Nil(t, err)
+			assert.True(t, revoked)
+			revoked, _ = m.IsTokenRevoked("other_jti")
+			assert.False(t, revoked)
+
+			client := m.Create("test_user", "test@test.com", "client_family", expireAt)
+			client.SetClient("127.0.0.1", "test-agent")
+			assert.Nil(t, m.Add("client_token", client))
+			m.Retire("client_token")
+			assert.Nil(t, m.Add("rotated_token", m.Rotate(client, expireAt)))
+
+			active, err := m.UserSessions("test_user")
+			assert.Nil(t, err)
+			assert.Len(t, active, 2)
+			families := []string{active[0].Family(), active[1].Family()}
+			assert.ElementsMatch(t, []string{"another_family", "client_family"}, families)
+			for _, s := range active {
+				if s.Family() == "client_family" {
+					assert.Equal(t, "127.0.0.1", s.IP())
+					assert.Equal(t, "test-agent", s.UserAgent())
+					assert.Equal(t, client.CreatedAt(), s.CreatedAt())
+					assert.NotZero(t, s.RefreshedAt())
+				}
+			}
+
+			assert.Nil(t, m.Add("other_user_token", m.Create("other_user", "other@test.com", "other_family", expireAt)))
+			assert.Nil(t, m.RevokeUser("test_user", RevokedByLogoutAll))
+			ok, _ = m.Get("another_token")
+			assert.False(t, ok)
+			ok, _ = m.Get("some_token_0")
+			assert.False(t, ok)
+			ok, _ = m.Get("other_user_token")
+			assert.True(t, ok)
+		})
+	}
+}
+
+func TestMemoryStore_Collect(t *testing.T) {
+	prepareBolt(t)
+	now := time.Now()
+	m := startManager(WithClock(func() time.Time { return now }))
+	defer m.Stop()
+
+	expireAt := now.Add(time.Minute).Unix()
+	m.Add("some_token", m.Create("test_user", "test@test.com", "test_family", expireAt))
+	store.AddRenewToken(store.RenewToken{Digest: "persisted_token", UserID: "test_user", Family: "other_family", ExpireAt: expireAt})
+	store.AddRenewToken(store.RenewToken{Digest: "retired_token", UserID: "test_user", Family: "other_family", ExpireAt: expireAt, Retired: true})
+
+	expired, err := m.store.Collect(now.Add(2 * time.Minute).Unix())
+	assert.Nil(t, err)
+	assert.Len(t, expired, 2)
+	families := []string{expired[0].Family(), expired[1].Family()}
+	assert.ElementsMatch(t, []string{"test_family", "other_family"}, families)
+
+	cleared, _ := store.ClearRenewTokens(now.Add(2 * time.Minute).Unix())
+	assert.Empty(t, cleared)
+	assert.Empty(t, storedSessions(m.store.(*MemoryStore)))
+}
+
+func TestBoltStore_Collect(t *testing.T) {
+	prepareBolt(t)
+	now := time.Now()
+	m := startManager(WithSessionStore(BoltStore{}), WithClock(func() time.Time { return now }))
+	defer m.Stop()
+
+	m.Add("some_token", m.Create("test_user", "test@test.com", "test_family", now.Add(time.Minute).Unix()))
+
+	expired, err := m.store.Collect(now.Unix())
+	assert.Nil(t, err)
+	assert.Empty(t, expired)
+
+	expired, err = m.store.Collect(now.Add(2 * time.Minute).Unix())
+	assert.Nil(t, err)
+	assert.Len(t, expired, 1)
+	assert.Empty(t, store.GetAllRenewTokens())
+}
+
+func TestRedisStore_Concurrency(t *testing.T) {
+	redis := startRedisStandIn(t)
+	defer redis.listener.Close()
+
+	m := startManager(WithSessionStore(NewRedisStore(redis.listener.Addr().String())))
+	defer m.Stop()
+
+	m.Add("some_token", m.Create("test_user", "test@test.com", "test_family", time.Now().Add(2*time.Minute).Unix()))
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	retired := 0
+	wg.Add(100)
+	for i := 0; i < 100; i++ {
+		go func() {
+			defer wg.Done()
+			if ok, _ := m.Retire("some_token"); ok {
+				mutex.Lock()
+				retired++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, retired)
+}
+
+func TestRedisStore_ShortSessionKeepsIndexes(t *testing.T) {
+	redis := startRedisStandIn(t)
+	defer redis.listener.Close()
+
+	sessionStore := NewRedisStore(redis.listener.Addr().String())
+	defer sessionStore.Close()
+
+	m := NewManager()
+	assert.Nil(t, sessionStore.Put("long_token", m.Create("test_user", "test@test.com", "long_family", time.Now().Add(2*time.Minute).Unix())))
+	assert.Nil(t, sessionStore.Put("old_token", m.Create("test_user", "test@test.com", "old_family", time.Now().Add(2*time.Minute).Unix())))
+	assert.Nil(t, sessionStore.Put("short_token", m.Create("test_user", "test@test.com", "old_family", time.Now().Add(time.Second).Unix())))
+
+	redis.mutex.Lock()
+	assert.True(t, time.Until(redis.expireAt[sessionStore.userKey("test_user")]) > time.Minute, "short session doesn't shorten user set TTL")
+	assert.True(t, time.Until(redis.expireAt[sessionStore.familyKey("old_family")]) > time.Minute, "short session doesn't shorten family set TTL")
+	redis.mutex.Unlock()
+
+	time.Sleep(1100 * time.Millisecond)
+	sessions, err := sessionStore.UserSessions("test_user")
+	assert.Nil(t, err)
+	assert.Len(t, sessions, 2)
+	assert.Contains(t, sessions, "long_token")
+
+	assert.Nil(t, sessionStore.Put("new_token", m.Create("test_user", "test@test.com", "new_family", time.Now().Add(time.Minute).Unix())))
+	redis.mutex.Lock()
+	assert.NotContains(t, redis.zsets[sessionStore.userKey("test_user")], "short_token", "expired token is pruned")
+	assert.Contains(t, redis.expireAt, sessionStore.userKey("test_user"), "user set expires")
+	redis.mutex.Unlock()
+
+	assert.Nil(t, sessionStore.DeleteFamily("old_family"))
+	s, _ := sessionStore.Get("old_token")
+	assert.Nil(t, s)
+
+	assert.Nil(t, sessionStore.DeleteUser("test_user"))
+	s, _ = sessionStore.Get("long_token")
+	assert.Nil(t, s)
+}
+
+func TestRedisStore_Multi(t *testing.T) {
+	redis := startRedisStandIn(t)
+	defer redis.listener.Close()
+
+	sessionStore := NewRedisStore(redis.listener.Addr().String())
+	defer sessionStore.Close()
+
+	replies, err := sessionStore.multi([]string{"SET", "some_key", "1"}, []string{"SADD", "some_set", "a", "b"})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"OK", int64(2)}, replies)
+
+	_, err = sessionStore.multi([]string{"SET", "other_key", "1"}, []string{"UNKNOWN"})
+	assert.IsType(t, RedisError(""), err)
+	reply, err := sessionStore.do("GET", "some_key")
+	assert.Nil(t, err, "connection is usable after failed transaction")
+	assert.Equal(t, "1", reply)
+}
+
+func TestRedisStore_Expiration(t *testing.T) {
+	redis := startRedisStandIn(t)
+	defer redis.listener.Close()
+
+	sessionStore := NewRedisStore(redis.listener.Addr().String())
+	defer sessionStore.Close()
+
+	m := NewManager()
+	assert.Nil(t, sessionStore.Put("expired_token", m.Create("test_user", "test@test.com", "test_family", time.Now().Add(-time.Minute).Unix())))
+	assert.Nil(t, sessionStore.Put("short_token", m.Create("test_user", "test@test.com", "test_family", time.Now().Add(time.Second).Unix())))
+
+	s, err := sessionStore.Get("expired_token")
+	assert.Nil(t, err)
+	assert.Nil(t, s)
+
+	time.Sleep(1100 * time.Millisecond)
+	s, _ = sessionStore.Get("short_token")
+	assert.Nil(t, s)
+}
+
+func TestSessionLimit(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	expireAt := now.Add(2 * time.Minute).Unix()
+
+	m := startManager(WithStore(&countingStore{}), WithClock(clock), WithSessionLimit(2, RejectNewSession))
+	defer m.Stop()
+
+	for i := 0; i < 2; i++ {
+		evicted, err := m.Open(fmt.Sprintf("some_token_%v", i), m.Create("test_user", "test@test.com", fmt.Sprintf("family_%v", i), expireAt))
+		assert.Nil(t, err)
+		assert.Empty(t, evicted)
+	}
+	_, err := m.Open("some_token_2", m.Create("test_user", "test@test.com", "family_2", expireAt))
+	assert.Equal(t, ErrSessionLimit, err)
+	ok, _ := m.Get("some_token_2")
+	assert.False(t, ok)
+
+	_, err = m.Open("other_token", m.Create("other_user", "other@test.com", "other_family", expireAt))
+	assert.Nil(t, err)
+
+	m.limitPolicy = EvictOldestSession
+	now = now.Add(time.Second)
+	evicted, err := m.Open("some_token_2", m.Create("test_user", "test@test.com", "family_2", expireAt))
+	assert.Nil(t, err)
+	assert.Len(t, evicted, 1)
+	assert.Equal(t, "family_0", evicted[0].Family())
+
+	ok, _ = m.Get("some_token_0")
+	assert.False(t, ok)
+	active, _ := m.UserSessions("test_user")
+	assert.Len(t, active, 2)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	m := startManager(WithStore(&countingStore{}), WithClock(clock), WithIdleTimeout(time.Hour), WithFixedExpiration())
+	defer m.Stop()
+
+	first := m.Create("test_user", "test@test.com", "test_family", now.Add(24*time.Hour).Unix())
+	assert.Equal(t, now.Add(time.Hour).Unix(), first.ExpireAt())
+	assert.Equal(t, now.Add(24*time.Hour).Unix(), first.MaxExpireAt())
+	m.Add("some_token_0", first)
+
+	now = now.Add(50 * time.Minute)
+	second := m.Rotate(first, now.Add(24*time.Hour).Unix())
+	assert.Equal(t, now.Add(time.Hour).Unix(), second.ExpireAt())
+	assert.Equal(t, first.MaxExpireAt(), second.MaxExpireAt())
+	m.Add("some_token_1", second)
+
+	now = now.Add(50 * time.Minute)
+	m.store.Collect(now.Unix())
+	ok, _ := m.Get("some_token_0")
+	assert.False(t, ok)
+	ok, _ = m.Get("some_token_1")
+	assert.True(t, ok)
+
+	now = now.Add(20 * time.Minute)
+	m.store.Collect(now.Unix())
+	ok, _ = m.Get("some_token_1")
+	assert.False(t, ok)
+}
+
+func TestSlidingExpiration(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	created := now
+
+	absolute := startManager(WithStore(&countingStore{}), WithClock(clock), WithFixedExpiration())
+	defer absolute.Stop()
+
+	s := absolute.Create("test_user", "test@test.com", "test_family", now.Add(24*time.Hour).Unix())
+	now = now.Add(12 * time.Hour)
+	s = absolute.Rotate(s, now.Add(24*time.Hour).Unix())
+	assert.Equal(t, created.Add(24*time.Hour).Unix(), s.ExpireAt())
+
+	now = created
+	sliding := startManager(WithStore(&countingStore{}), WithClock(clock), WithSlidingExpiration(48*time.Hour))
+	defer sliding.Stop()
+
+	s = sliding.Create("test_user", "test@test.com", "test_family", now.Add(24*time.Hour).Unix())
+	now = now.Add(12 * time.Hour)
+	s = sliding.Rotate(s, now.Add(24*time.Hour).Unix())
+	assert.Equal(t, now.Add(24*time.Hour).Unix(), s.ExpireAt())
+
+	now = now.Add(30 * time.Hour)
+	s = sliding.Rotate(s, now.Add(24*time.Hour).Unix())
+	assert.Equal(t, created.Add(48*time.Hour).Unix(), s.ExpireAt())
+	assert.Equal(t, created.Unix(), s.CreatedAt())
+
+	now = created
+	unlimited := startManager(WithStore(&countingStore{}), WithClock(clock))
+	defer unlimited.Stop()
+
+	s = unlimited.Create("test_user", "test@test.com", "test_family", now.Add(24*time.Hour).Unix())
+	now = now.Add(72 * time.Hour)
+	s = unlimited.Rotate(s, now.Add(24*time.Hour).Unix())
+	assert.Equal(t, now.Add(24*time.Hour).Unix(), s.ExpireAt())
+}
+
+//serializedStore funnels all calls through single goroutine like sessions runtime did before sharding.
+//It is a baseline of benchmarks
+type serializedStore struct {
+	*MemoryStore
+	stream chan func()
+}
+
+func newSerializedStore(m *MemoryStore) *serializedStore {
+	s := &serializedStore{MemoryStore: m, stream: make(chan func())}
+	go func() {
+		for call := range s.stream {
+			call()
+		}
+	}()
+	return s
+}
+
+func (s *serializedStore) call(f func()) {
+	done := make(chan bool, 1)
+	s.stream <- func() {
+		f()
+		done <- true
+	}
+	<-done
+}
+
+func (s *serializedStore) Put(token string, session *Session) (err error) {
+	s.call(func() { err = s.MemoryStore.Put(token, session) })
+	return
+}
+
+func (s *serializedStore) Get(token string) (session *Session, err error) {
+	s.call(func() { session, err = s.MemoryStore.Get(token) })
+	return
+}
+
+func (s *serializedStore) Retire(token string) (ok bool, err error) {
+	s.call(func() { ok, err = s.MemoryStore.Retire(token) })
+	return
+}
+
+func benchmarkSessionStore(b *testing.B, sessionStore SessionStore, operation func(m *Manager, token string)) {
+	m := NewManager(WithSessionStore(sessionStore))
+	m.Start(context.Background())
+	defer m.Stop()
+
+	expireAt := time.Now().Add(time.Hour).Unix()
+	tokens := make([]string, 1000)
+	for i := range tokens {
+		tokens[i] = fmt.Sprintf("some_token_%v", i)
+		m.Add(tokens[i], m.Create("test_user", "test@test.com", "test_family", expireAt))
+	}
+
+	var seed int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		n := int(atomic.AddInt64(&seed, 97))
+		for pb.Next() {
+			n++
+			operation(m, tokens[n%len(tokens)])
+		}
+	})
+}
+
+func benchmarkMemoryStores(b *testing.B, operation func(m *Manager, token string)) {
+	memory := func(shards int) *MemoryStore {
+		return newMemoryStore(&countingStore{}, time.Millisecond, time.Now, shards)
+	}
+
+	b.Run("single goroutine", func(b *testing.B) {
+		benchmarkSessionStore(b, newSerializedStore(memory(1)), operation)
+	})
+	b.Run("single shard", func(b *testing.B) {
+		benchmarkSessionStore(b, memory(1), operation)
+	})
+	b.Run("sharded", func(b *testing.B) {
+		benchmarkSessionStore(b, memory(defaultShards), operation)
+	})
+}
+
+func BenchmarkMemoryStore_Get(b *testing.B) {
+	benchmarkMemoryStores(b, func(m *Manager, token string) {
+		m.Get(token)
+	})
+}
+
+//BenchmarkMemoryStore_Mixed adds unexpired sessions, so writes into persistent store are measured too
+func BenchmarkMemoryStore_Mixed(b *testing.B) {
+	expireAt := time.Now().Add(time.Hour).Unix()
+	benchmarkMemoryStores(b, func(m *Manager, token string) {
+		m.Get(token)
+		m.Retire(token)
+		m.Add(token, m.Create("test_user", "test@test.com", "test_family", expireAt))
+	})
+}
+
+func TestEvents(t *testing.T) {
+	now := time.Now()
+	m := startManager(WithStore(&countingStore{}), WithClock(func() time.Time { return now }), WithSessionLimit(1, EvictOldestSession))
+
+	var events []Event
+	unsubscribe := m.Subscribe(func(e Event) {
+		events = append(events, e)
+	})
+
+	expireAt := now.Add(2 * time.Minute).Unix()
+	first := m.Create("test_user", "test@test.com", "first_family", expireAt)
+	m.Open("first_token", first)
+	m.Retire("first_token")
+	m.Add("rotated_token", m.Rotate(first, expireAt))
+
+	m.Open("second_token", m.Create("test_user", "test@test.com", "second_family", expireAt))
+	m.Add("expired_token", m.Create("other_user", "other@test.com", "expired_family", 0))
+	m.RevokeUser("test_user", RevokedByLogoutAll)
+
+	for _, s := range m.store.(*MemoryStore).garbageCollector(now.Unix()) {
+		m.emit(SessionExpired, s, "")
+	}
+
+	m.Stop()
+	unsubscribe()
+
+	expected := []Event{
+		{Type: SessionCreated, UserID: "test_user", Email: "test@test.com", Family: "first_family"},
+		{Type: SessionRefreshed, UserID: "test_user", Email: "test@test.com", Family: "first_family"},
+		{Type: SessionRevoked, UserID: "test_user", Email: "test@test.com", Family: "first_family", Reason: RevokedByEviction},
+		{Type: SessionCreated, UserID: "test_user", Email: "test@test.com", Family: "second_family"},
+		{Type: SessionCreated, UserID: "other_user", Email: "other@test.com", Family: "expired_family"},
+		{Type: SessionRevoked, UserID: "test_user", Email: "test@test.com", Family: "second_family", Reason: RevokedByLogoutAll},
+		{Type: SessionExpired, UserID: "other_user", Email: "other@test.com", Family: "expired_family"},
+	}
+	assert.Len(t, events, len(expected))
+	for i := range events {
+		events[i].Time = time.Time{}
+	}
+	assert.Equal(t, expected, events)
+}
+
+func TestEvents_FromScheduler(t *testing.T) {
+	m := startManager(WithStore(&countingStore{}), WithGCInterval(100*time.Millisecond))
+	defer m.Stop()
+
+	expired := make(chan Event, 1)
+	m.Subscribe(func(e Event) {
+		if e.Type == SessionExpired {
+			expired <- e
+		}
+	})
+	m.Add("some_token", m.Create("test_user", "test@test.com", "test_family", 0))
+
+	select {
+	case e := <-expired:
+		assert.Equal(t, "test_family", e.Family)
+	case <-time.After(time.Second):
+		t.Fatal("expired event is not emitted")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	cases := []struct {
+		ip        string
+		userAgent string
+		expected  Fingerprint
+	}{
+		{"192.168.1.17", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0.4430.93 Safari/537.36", Fingerprint{"192.168.1.0/24", "Chrome"}},
+		{"2001:db8:1:2::17", "Mozilla/5.0 (X11; Linux x86_64; rv:88.0) Gecko/20100101 Firefox/88.0", Fingerprint{"2001:db8:1::/48", "Firefox"}},
+		{"10.0.0.1", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.1 Safari/605.1.15", Fingerprint{"10.0.0.0/24", "Safari"}},
+		{"10.0.0.1", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0.4430.93 Safari/537.36 Edg/90.0.818.56", Fingerprint{"10.0.0.0/24", "Edge"}},
+		{"10.0.0.1", "curl/7.68.0", Fingerprint{"10.0.0.0/24", "curl"}},
+		{"", "", Fingerprint{"", ""}},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, NewFingerprint(c.ip, c.userAgent))
+	}
+}
+
+func TestBind(t *testing.T) {
+	const chrome = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0.4430.93 Safari/537.36"
+	expireAt := time.Now().Add(2 * time.Minute).Unix()
+
+	for _, policy := range []BindingPolicy{AllowClientMismatch, LogClientMismatch, ReauthClientMismatch} {
+		m := startManager(WithStore(&countingStore{}), WithBindingPolicy(policy))
+
+		s := m.Create("test_user", "test@test.com", "test_family", expireAt)
+		s.SetClient("192.168.1.17", chrome)
+		m.Add("some_token", s)
+
+		assert.Nil(t, m.Bind(s, "192.168.1.200", chrome))
+		ok, _ := m.Get("some_token")
+		assert.True(t, ok)
+
+		err := m.Bind(s, "10.0.0.1", "curl/7.68.0")
+		ok, _ = m.Get("some_token")
+		if policy == ReauthClientMismatch {
+			assert.Equal(t, ErrClientMismatch, err)
+			assert.False(t, ok)
+		} else {
+			assert.Nil(t, err)
+			assert.True(t, ok)
+		}
+
+		unbound := m.Create("test_user", "test@test.com", "unbound_family", expireAt)
+		m.Add("unbound_token", unbound)
+		assert.Nil(t, m.Bind(unbound, "10.0.0.1", "curl/7.68.0"))
+		ok, _ = m.Get("unbound_token")
+		assert.True(t, ok)
+		m.Stop()
+	}
+}
@@ -0,0 +1,579 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const userBucket = "Users"
+const userEmailsBucket = "UserEmails"
+const userNicknamesBucket = "UserNicknames"
+const renewTokensBucket = "RenewTokens"
+const userRenewTokensBucket = "UserRenewTokens"
+const familyRenewTokensBucket = "FamilyRenewTokens"
+const revokedTokensBucket = "RevokedTokens"
+
+var database *bolt.DB
+
+//BoltStore keeps users by ID and renew tokens in bolt. Users are indexed by email and nickname,
+//renew tokens by user and by family
+type BoltStore struct {
+	db *bolt.DB
+}
+
+//NewBoltStore creates store of bolt database db. Missing buckets are created and pending migrations are applied
+func NewBoltStore(db *bolt.DB) (*BoltStore, error) {
+	if _, err := Migrate(db, false); err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+//OpenDatabase opens connection to the persistent DB. Package functions use it as store of users and renew tokens
+func OpenDatabase(store string) error {
+	db, err := bolt.Open(store, 0600, nil)
+	if err != nil {
+		return err
+	}
+	database = db
+
+	boltStore, err := NewBoltStore(db)
+	if err != nil {
+		return err
+	}
+	UseStores(boltStore, boltStore)
+	return nil
+}
+
+//CreateDefaultBacket create default backet for correct DB work
+func CreateDefaultBacket() error {
+	return database.Update(createBuckets)
+}
+
+func createBuckets(tx *bolt.Tx) error {
+	for _, name := range []string{metaBucket, userBucket, userEmailsBucket, userNicknamesBucket, renewTokensBucket, userRenewTokensBucket, familyRenewTokensBucket, revokedTokensBucket} {
+		if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//CloseDatabase closes connection and release all resources
+func CloseDatabase() {
+	database.Close()
+}
+
+//DropDatabase cleare all data form database
+func DropDatabase() error {
+	return database.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(metaBucket)); err != nil {
+			return err
+		}
+
+		if err := tx.DeleteBucket([]byte(userBucket)); err != nil {
+			return err
+		}
+
+		if err := tx.DeleteBucket([]byte(userEmailsBucket)); err != nil {
+			return err
+		}
+
+		if err := tx.DeleteBucket([]byte(userNicknamesBucket)); err != nil {
+			return err
+		}
+
+		if err := tx.DeleteBucket([]byte(renewTokensBucket)); err != nil {
+			return err
+		}
+
+		if err := tx.DeleteBucket([]byte(userRenewTokensBucket)); err != nil {
+			return err
+		}
+
+		if err := tx.DeleteBucket([]byte(familyRenewTokensBucket)); err != nil {
+			return err
+		}
+
+		if err := tx.DeleteBucket([]byte(revokedTokensBucket)); err != nil {
+			return err
+		}
+
+		return nil
+	})
+}
+
+//Create checks email and nickname indexes and writes user into Users bucket in one transaction
+func (s *BoltStore) Create(user *User) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		emails := tx.Bucket([]byte(userEmailsBucket))
+		if emails.Get([]byte(user.Email)) != nil {
+			return ErrEmailTaken
+		}
+		nicknames := tx.Bucket([]byte(userNicknamesBucket))
+		nickname := []byte(nicknameKey(user.Nickname))
+		if len(nickname) > 0 {
+			if nicknames.Get(nickname) != nil {
+				return ErrNicknameTaken
+			}
+			if err := nicknames.Put(nickname, []byte(user.ID)); err != nil {
+				return err
+			}
+		}
+		if err := emails.Put([]byte(user.Email), []byte(user.ID)); err != nil {
+			return err
+		}
+		return putUser(tx, user)
+	})
+}
+
+//GetUserByID reads user from Users bucket
+func (s *BoltStore) GetUserByID(id string) (bool, *User) {
+	var user *User
+	err := s.db.View(func(tx *bolt.Tx) (err error) {
+		user, err = getUser(tx, []byte(id))
+		return
+	})
+	if err != nil {
+		log.Println("Error while getting user by id: ", err.Error())
+	}
+	if user == nil {
+		return false, &User{}
+	}
+	return true, user
+}
+
+//GetUserByEmail reads user by ID found in email index
+func (s *BoltStore) GetUserByEmail(email string) (bool, *User) {
+	var user *User
+	err := s.db.View(func(tx *bolt.Tx) (err error) {
+		user, err = getUserByEmail(tx, email)
+		return
+	})
+	if err != nil {
+		log.Println("Error while getting user by email: ", err.Error())
+	}
+	if user == nil {
+		return false, &User{}
+	}
+	return true, user
+}
+
+//GetUserByNickname reads user by ID found in nickname index
+func (s *BoltStore) GetUserByNickname(nickname string) (bool, *User) {
+	var user *User
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket([]byte(userNicknamesBucket)).Get([]byte(nicknameKey(nickname)))
+		if id == nil {
+			return nil
+		}
+		var err error
+		user, err = getUser(tx, id)
+		return err
+	})
+	if err != nil {
+		log.Println("Error while getting user by nickname: ", err.Error())
+	}
+	if user == nil {
+		return false, &User{}
+	}
+	return true, user
+}
+
+//SetEmail replaces email of the user and its index entry in one transaction
+func (s *BoltStore) SetEmail(id string, email string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		user, err := getUser(tx, []byte(id))
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return ErrUserNotFound
+		}
+
+		emails := tx.Bucket([]byte(userEmailsBucket))
+		if owner := emails.Get([]byte(email)); owner != nil && string(owner) != id {
+			return ErrEmailTaken
+		}
+		if err := emails.Delete([]byte(user.Email)); err != nil {
+			return err
+		}
+		if err := emails.Put([]byte(email), []byte(id)); err != nil {
+			return err
+		}
+
+		user.Email = email
+		return putUser(tx, user)
+	})
+}
+
+//SetPassword replaces hashed password of the user in one transaction
+func (s *BoltStore) SetPassword(id string, hashedPwd string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		user, err := getUser(tx, []byte(id))
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return ErrUserNotFound
+		}
+
+		user.HashedPwd = hashedPwd
+		return putUser(tx, user)
+	})
+}
+
+//getUser reads user by ID, nil if there is no such user
+func getUser(tx *bolt.Tx, id []byte) (*User, error) {
+	data := tx.Bucket([]byte(userBucket)).Get(id)
+	if data == nil {
+		return nil, nil
+	}
+
+	var user User
+	if err := json.Unmarshal(data, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func getUserByEmail(tx *bolt.Tx, email string) (*User, error) {
+	id := tx.Bucket([]byte(userEmailsBucket)).Get([]byte(email))
+	if id == nil {
+		return nil, nil
+	}
+	return getUser(tx, id)
+}
+
+func putUser(tx *bolt.Tx, user *User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(userBucket)).Put([]byte(user.ID), data)
+}
+
+//AddRenewTokens adds renew tokens to database in one transaction
+func (s *BoltStore) AddRenewTokens(tokens []RenewToken) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(renewTokensBucket))
+
+		for _, token := range tokens {
+			data, err := json.Marshal(token)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(token.Digest), data); err != nil {
+				return err
+			}
+			if err := indexRenewToken(tx, &token); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//DeleteRenewToken delete renew token from database by digest
+func (s *BoltStore) DeleteRenewToken(digest string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(renewTokensBucket))
+		if data := b.Get([]byte(digest)); data != nil {
+			if t, err := decodeRenewToken(digest, data); err == nil {
+				if err := unindexRenewToken(tx, t); err != nil {
+					return err
+				}
+			}
+		}
+
+		return b.Delete([]byte(digest))
+	})
+	return err
+}
+
+//RetireRenewToken marks renew token with digest as exchanged. Check and update are done in one
+//transaction, so it returns false if token is unknown or already retired
+func (s *BoltStore) RetireRenewToken(digest string) (bool, error) {
+	var retired bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(renewTokensBucket))
+		data := b.Get([]byte(digest))
+		if data == nil {
+			return nil
+		}
+
+		t, err := decodeRenewToken(digest, data)
+		if err != nil {
+			return err
+		}
+		if t.Retired {
+			return nil
+		}
+		t.Retired = true
+
+		if data, err = json.Marshal(t); err != nil {
+			return err
+		}
+		if err := b.Put([]byte(digest), data); err != nil {
+			return err
+		}
+		retired = true
+		return nil
+	})
+	return retired, err
+}
+
+//DeleteRenewFamily deletes all renew tokens of the family found by family index
+func (s *BoltStore) DeleteRenewFamily(family string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(renewTokensBucket))
+		c := tx.Bucket([]byte(familyRenewTokensBucket)).Cursor()
+
+		prefix := familyTokenKey(family, "")
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			digest := k[len(prefix):]
+			if data := b.Get(digest); data != nil {
+				if t, err := decodeRenewToken(string(digest), data); err == nil {
+					if err := tx.Bucket([]byte(userRenewTokensBucket)).Delete(userTokenKey(t.UserID, t.Digest)); err != nil {
+						return err
+					}
+				}
+				if err := b.Delete(digest); err != nil {
+					return err
+				}
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//GetRenewToken get unexpired renew token from database by digest
+func (s *BoltStore) GetRenewToken(digest string) (bool, *RenewToken) {
+	var t RenewToken
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(renewTokensBucket))
+		data := b.Get([]byte(digest))
+		if data == nil {
+			return nil
+		}
+		decoded, err := decodeRenewToken(digest, data)
+		if err != nil {
+			return err
+		}
+		t = *decoded
+		found = time.Now().Unix() < t.ExpireAt
+		return nil
+	})
+	if err != nil {
+		log.Println("Error while getting renew token: ", err.Error())
+	}
+	return found, &t
+}
+
+//GetAllRenewTokens returns all renew tokens
+func (s *BoltStore) GetAllRenewTokens() []RenewToken {
+	tokens := make([]RenewToken, 0, 10)
+	now := time.Now().Unix()
+	s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(renewTokensBucket))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			t, err := decodeRenewToken(string(k), v)
+			if err != nil {
+				log.Println("Error while reading renew token: ", err.Error())
+				continue
+			}
+
+			if now < t.ExpireAt {
+				tokens = append(tokens, *t)
+			}
+		}
+		return nil
+	})
+	return tokens
+}
+
+//ClearRenewTokens deletes all tokens expired before now from database. Returns deleted tokens
+func (s *BoltStore) ClearRenewTokens(now int64) ([]RenewToken, error) {
+	var cleared []RenewToken
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(renewTokensBucket))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; {
+			t, err := decodeRenewToken(string(k), v)
+			if err != nil || now > t.ExpireAt {
+				key := append([]byte(nil), k...)
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				if t != nil {
+					if err := unindexRenewToken(tx, t); err != nil {
+						return err
+					}
+					cleared = append(cleared, *t)
+				}
+				k, v = c.Seek(key)
+				continue
+			}
+			k, v = c.Next()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cleared, nil
+}
+
+//GetUserRenewTokens returns all unexpired renew tokens of the user
+func (s *BoltStore) GetUserRenewTokens(userID string) []RenewToken {
+	tokens := make([]RenewToken, 0, 10)
+	now := time.Now().Unix()
+	s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(renewTokensBucket))
+		c := tx.Bucket([]byte(userRenewTokensBucket)).Cursor()
+
+		prefix := userTokenKey(userID, "")
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			digest := string(k[len(prefix):])
+			data := b.Get([]byte(digest))
+			if data == nil {
+				continue
+			}
+
+			t, err := decodeRenewToken(digest, data)
+			if err != nil {
+				log.Println("Error while reading renew token: ", err.Error())
+				continue
+			}
+			if now < t.ExpireAt {
+				tokens = append(tokens, *t)
+			}
+		}
+		return nil
+	})
+	return tokens
+}
+
+//DeleteUserRenewTokens deletes all renew tokens of the user
+func (s *BoltStore) DeleteUserRenewTokens(userID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deleteUserRenewTokens(tx, userID)
+	})
+}
+
+//deleteUserRenewTokens deletes renew tokens indexed under owner. Before schema version 6 owners are emails
+func deleteUserRenewTokens(tx *bolt.Tx, owner string) error {
+	b := tx.Bucket([]byte(renewTokensBucket))
+	c := tx.Bucket([]byte(userRenewTokensBucket)).Cursor()
+
+	prefix := userTokenKey(owner, "")
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+		digest := k[len(prefix):]
+		if data := b.Get(digest); data != nil {
+			if t, err := decodeRenewToken(string(digest), data); err == nil {
+				if err := tx.Bucket([]byte(familyRenewTokensBucket)).Delete(familyTokenKey(t.Family, t.Digest)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := b.Delete(digest); err != nil {
+			return err
+		}
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//indexRenewToken adds renew token into user and family indexes
+func indexRenewToken(tx *bolt.Tx, t *RenewToken) error {
+	if err := tx.Bucket([]byte(userRenewTokensBucket)).Put(userTokenKey(t.UserID, t.Digest), nil); err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(familyRenewTokensBucket)).Put(familyTokenKey(t.Family, t.Digest), nil)
+}
+
+//AddRevokedToken writes expiration time of revoked auth token by its ID
+func (s *BoltStore) AddRevokedToken(id string, expireAt int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		data := make([]byte, 8)
+		binary.LittleEndian.PutUint64(data, uint64(expireAt))
+		return tx.Bucket([]byte(revokedTokensBucket)).Put([]byte(id), data)
+	})
+}
+
+//IsTokenRevoked checks if ID of auth token is in RevokedTokens bucket
+func (s *BoltStore) IsTokenRevoked(id string) (bool, error) {
+	var revoked bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		revoked = tx.Bucket([]byte(revokedTokensBucket)).Get([]byte(id)) != nil
+		return nil
+	})
+	return revoked, err
+}
+
+//ClearRevokedTokens deletes IDs of revoked auth tokens expired before now
+func (s *BoltStore) ClearRevokedTokens(now int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(revokedTokensBucket)).Cursor()
+		for k, v := c.First(); k != nil; {
+			if len(v) == 8 && now <= int64(binary.LittleEndian.Uint64(v)) {
+				k, v = c.Next()
+				continue
+			}
+			key := append([]byte(nil), k...)
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			k, v = c.Seek(key)
+		}
+		return nil
+	})
+}
+
+//unindexRenewToken removes renew token from user and family indexes
+func unindexRenewToken(tx *bolt.Tx, t *RenewToken) error {
+	if err := tx.Bucket([]byte(userRenewTokensBucket)).Delete(userTokenKey(t.UserID, t.Digest)); err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(familyRenewTokensBucket)).Delete(familyTokenKey(t.Family, t.Digest))
+}
+
+//familyTokenKey returns key of family index entry, separated like userTokenKey
+func familyTokenKey(family string, digest string) []byte {
+	return []byte(family + "\x00" + digest)
+}
+
+//userTokenKey returns key of user index entry. Zero byte separates user ID from digest,
+//so prefix of one ID never matches another one
+func userTokenKey(userID string, digest string) []byte {
+	return []byte(userID + "\x00" + digest)
+}
+
+//decodeRenewToken decodes token record. Records created before families were
+//introduced contain expiration time only
+func decodeRenewToken(digest string, data []byte) (*RenewToken, error) {
+	t := RenewToken{Digest: digest}
+	if len(data) == 8 {
+		t.ExpireAt = int64(binary.LittleEndian.Uint64(data))
+		return &t, nil
+	}
+
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,42 @@
+package store
+
+import "strings"
+
+//providerRules enables address rules of mail providers in CanonicalEmail
+var providerRules bool
+
+//UseProviderRules enables rules of mail providers which deliver different addresses to one mailbox,
+//such as dots and plus tags of Gmail. Enable it before users are registered: stored emails
+//are not rewritten when it's switched
+func UseProviderRules(enabled bool) {
+	providerRules = enabled
+}
+
+//gmailDomains are domains of one Gmail mailbox, the first one is canonical
+var gmailDomains = []string{"gmail.com", "googlemail.com"}
+
+//CanonicalEmail returns form of email used to store and look up users. Spaces around email are trimmed
+//and it's lowercased: domains are case insensitive and so are local parts at all major providers.
+//With provider rules dots and plus tag of Gmail local part are dropped
+func CanonicalEmail(email string) string {
+	return canonicalEmail(email, providerRules)
+}
+
+func canonicalEmail(email string, withProviderRules bool) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	at := strings.LastIndex(email, "@")
+	if at < 0 || !withProviderRules {
+		return email
+	}
+
+	local, domain := email[:at], email[at+1:]
+	for _, gmail := range gmailDomains {
+		if domain == gmail {
+			if plus := strings.Index(local, "+"); plus >= 0 {
+				local = local[:plus]
+			}
+			return strings.Replace(local, ".", "", -1) + "@" + gmailDomains[0]
+		}
+	}
+	return email
+}
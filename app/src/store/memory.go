@@ -0,0 +1,261 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+//MemoryStore keeps users and renew tokens in maps. Data is lost on restart,
+//so it suits tests and single instance deployments which don't need persistence
+type MemoryStore struct {
+	sync.RWMutex
+	users     map[string]User
+	emails    map[string]string
+	nicknames map[string]string
+	tokens    map[string]RenewToken
+	revoked   map[string]int64
+}
+
+//NewMemoryStore creates empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:     make(map[string]User),
+		emails:    make(map[string]string),
+		nicknames: make(map[string]string),
+		tokens:    make(map[string]RenewToken),
+		revoked:   make(map[string]int64),
+	}
+}
+
+//Create writes copy of the user if no user has its email or nickname
+func (s *MemoryStore) Create(user *User) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, taken := s.emails[user.Email]; taken {
+		return ErrEmailTaken
+	}
+	nickname := nicknameKey(user.Nickname)
+	if _, taken := s.nicknames[nickname]; taken && nickname != "" {
+		return ErrNicknameTaken
+	}
+	s.users[user.ID] = *user
+	s.emails[user.Email] = user.ID
+	if nickname != "" {
+		s.nicknames[nickname] = user.ID
+	}
+	return nil
+}
+
+//GetUserByID returns copy of the user
+func (s *MemoryStore) GetUserByID(id string) (bool, *User) {
+	s.RLock()
+	defer s.RUnlock()
+
+	user, found := s.users[id]
+	return found, &user
+}
+
+//GetUserByEmail returns copy of the user
+func (s *MemoryStore) GetUserByEmail(email string) (bool, *User) {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.userOf(s.emails, email)
+}
+
+//GetUserByNickname returns copy of the user
+func (s *MemoryStore) GetUserByNickname(nickname string) (bool, *User) {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.userOf(s.nicknames, nicknameKey(nickname))
+}
+
+//userOf returns copy of the user with ID found in index by key
+func (s *MemoryStore) userOf(index map[string]string, key string) (bool, *User) {
+	id, found := index[key]
+	if !found {
+		return false, &User{}
+	}
+	user, found := s.users[id]
+	return found, &user
+}
+
+//SetEmail replaces email of the user
+func (s *MemoryStore) SetEmail(id string, email string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	user, found := s.users[id]
+	if !found {
+		return ErrUserNotFound
+	}
+	if owner, taken := s.emails[email]; taken && owner != id {
+		return ErrEmailTaken
+	}
+
+	delete(s.emails, user.Email)
+	s.emails[email] = id
+	user.Email = email
+	s.users[id] = user
+	return nil
+}
+
+//SetPassword replaces hashed password of the user
+func (s *MemoryStore) SetPassword(id string, hashedPwd string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	user, found := s.users[id]
+	if !found {
+		return ErrUserNotFound
+	}
+	user.HashedPwd = hashedPwd
+	s.users[id] = user
+	return nil
+}
+
+//AddRenewTokens writes renew tokens under one lock
+func (s *MemoryStore) AddRenewTokens(tokens []RenewToken) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, token := range tokens {
+		s.tokens[token.Digest] = token
+	}
+	return nil
+}
+
+//GetRenewToken returns unexpired renew token by digest
+func (s *MemoryStore) GetRenewToken(digest string) (bool, *RenewToken) {
+	s.RLock()
+	defer s.RUnlock()
+
+	t, found := s.tokens[digest]
+	return found && time.Now().Unix() < t.ExpireAt, &t
+}
+
+//RetireRenewToken marks renew token as exchanged under the lock, so only one of concurrent callers succeeds
+func (s *MemoryStore) RetireRenewToken(digest string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	t, found := s.tokens[digest]
+	if !found || t.Retired {
+		return false, nil
+	}
+	t.Retired = true
+	s.tokens[digest] = t
+	return true, nil
+}
+
+//DeleteRenewToken deletes renew token by digest
+func (s *MemoryStore) DeleteRenewToken(digest string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.tokens, digest)
+	return nil
+}
+
+//DeleteRenewFamily deletes all renew tokens of the family
+func (s *MemoryStore) DeleteRenewFamily(family string) error {
+	return s.deleteTokens(func(t *RenewToken) bool {
+		return t.Family == family
+	})
+}
+
+//GetAllRenewTokens returns all unexpired renew tokens
+func (s *MemoryStore) GetAllRenewTokens() []RenewToken {
+	return s.tokensOf(func(t *RenewToken) bool {
+		return true
+	})
+}
+
+//ClearRenewTokens deletes renew tokens expired before now. Returns deleted tokens
+func (s *MemoryStore) ClearRenewTokens(now int64) ([]RenewToken, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var cleared []RenewToken
+	for digest, t := range s.tokens {
+		if now > t.ExpireAt {
+			delete(s.tokens, digest)
+			cleared = append(cleared, t)
+		}
+	}
+	return cleared, nil
+}
+
+//GetUserRenewTokens returns unexpired renew tokens of the user
+func (s *MemoryStore) GetUserRenewTokens(userID string) []RenewToken {
+	return s.tokensOf(func(t *RenewToken) bool {
+		return t.UserID == userID
+	})
+}
+
+//DeleteUserRenewTokens deletes all renew tokens of the user
+func (s *MemoryStore) DeleteUserRenewTokens(userID string) error {
+	return s.deleteTokens(func(t *RenewToken) bool {
+		return t.UserID == userID
+	})
+}
+
+//AddRevokedToken writes expiration time of revoked auth token by its ID
+func (s *MemoryStore) AddRevokedToken(id string, expireAt int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.revoked[id] = expireAt
+	return nil
+}
+
+//IsTokenRevoked checks if auth token with the ID was revoked
+func (s *MemoryStore) IsTokenRevoked(id string) (bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	_, revoked := s.revoked[id]
+	return revoked, nil
+}
+
+//ClearRevokedTokens deletes IDs of revoked auth tokens expired before now
+func (s *MemoryStore) ClearRevokedTokens(now int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for id, expireAt := range s.revoked {
+		if now > expireAt {
+			delete(s.revoked, id)
+		}
+	}
+	return nil
+}
+
+//tokensOf returns unexpired renew tokens matching the filter
+func (s *MemoryStore) tokensOf(match func(t *RenewToken) bool) []RenewToken {
+	s.RLock()
+	defer s.RUnlock()
+
+	tokens := make([]RenewToken, 0, 10)
+	now := time.Now().Unix()
+	for _, t := range s.tokens {
+		if now < t.ExpireAt && match(&t) {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+func (s *MemoryStore) deleteTokens(match func(t *RenewToken) bool) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for digest, t := range s.tokens {
+		if match(&t) {
+			delete(s.tokens, digest)
+		}
+	}
+	return nil
+}
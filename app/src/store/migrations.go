@@ -0,0 +1,363 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const metaBucket = "Meta"
+
+var schemaVersionKey = []byte("SchemaVersion")
+
+//dryRunLockTimeout is how long dry run waits for database file locked by running service
+const dryRunLockTimeout = time.Second
+
+//errDryRun rolls back transaction of dry run
+var errDryRun = errors.New("dry run")
+
+//Migration upgrades bolt database from previous schema version to Version
+type Migration struct {
+	Version     int
+	Description string
+
+	up func(tx *bolt.Tx) error
+}
+
+//migrations are applied in order. Append new ones to the end, never change or remove applied ones
+var migrations = []Migration{
+	{Version: 1, Description: "Replace renew tokens stored as raw JWT with their digests", up: hashRawRenewTokens},
+	{Version: 2, Description: "Index renew tokens by user", up: indexUserRenewTokens},
+	{Version: 3, Description: "Key users by generated ID and index them by email", up: assignUserIDs},
+	{Version: 4, Description: "Store emails in canonical form, report colliding ones", up: canonicalizeEmails},
+	{Version: 5, Description: "Index users by nickname, report colliding ones", up: indexUserNicknames},
+	{Version: 6, Description: "Index renew tokens by user ID instead of email", up: indexRenewTokensByUserID},
+	{Version: 7, Description: "Index renew tokens by family", up: indexRenewTokensByFamily},
+}
+
+//SchemaVersion returns version of the newest migration known to this build
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+//Migrate applies pending migrations to db. Each migration and the schema version it sets are written
+//in one transaction, so failed migration leaves database at the previous version.
+//With dryRun migrations are applied in one transaction which is rolled back.
+//Returns migrations which are or would be applied
+func Migrate(db *bolt.DB, dryRun bool) ([]Migration, error) {
+	if dryRun {
+		var pending []Migration
+		err := db.Update(func(tx *bolt.Tx) error {
+			var err error
+			if pending, err = pendingMigrations(tx); err != nil {
+				return err
+			}
+			for _, m := range pending {
+				if err := m.up(tx); err != nil {
+					return fmt.Errorf("migration %d: %s", m.Version, err.Error())
+				}
+			}
+			return errDryRun
+		})
+		if err != errDryRun {
+			return nil, err
+		}
+		return pending, nil
+	}
+
+	var pending []Migration
+	if err := db.Update(func(tx *bolt.Tx) (err error) {
+		pending, err = pendingMigrations(tx)
+		return
+	}); err != nil {
+		return nil, err
+	}
+
+	for i, m := range pending {
+		err := db.Update(func(tx *bolt.Tx) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+			return tx.Bucket([]byte(metaBucket)).Put(schemaVersionKey, []byte(strconv.Itoa(m.Version)))
+		})
+		if err != nil {
+			return pending[:i], fmt.Errorf("migration %d: %s", m.Version, err.Error())
+		}
+		log.Printf("Database is migrated to version %d: %s", m.Version, m.Description)
+	}
+	return pending, nil
+}
+
+//DryRunMigrations reports migrations pending for database file at path and checks they succeed, database is not changed.
+//Fails if there is no such file or it stays locked by running service longer than dryRunLockTimeout
+func DryRunMigrations(path string) ([]Migration, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: dryRunLockTimeout})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	return Migrate(db, true)
+}
+
+//pendingMigrations creates buckets missing in tx and returns migrations newer than schema version of the database
+func pendingMigrations(tx *bolt.Tx) ([]Migration, error) {
+	if err := createBuckets(tx); err != nil {
+		return nil, err
+	}
+
+	version, err := schemaVersion(tx)
+	if err != nil {
+		return nil, err
+	}
+	if version > SchemaVersion() {
+		return nil, fmt.Errorf("database schema version %d is newer than supported %d", version, SchemaVersion())
+	}
+
+	var pending []Migration
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+//schemaVersion reads schema version of the database. Databases created before versioning have version 0
+func schemaVersion(tx *bolt.Tx) (int, error) {
+	data := tx.Bucket([]byte(metaBucket)).Get(schemaVersionKey)
+	if data == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(data))
+}
+
+//hashRawRenewTokens replaces renew tokens stored as raw JWT with their digests
+func hashRawRenewTokens(tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(renewTokensBucket))
+	raw := make(map[string][]byte)
+
+	b.ForEach(func(k, v []byte) error {
+		if bytes.ContainsRune(k, '.') {
+			raw[string(k)] = append([]byte(nil), v...)
+		}
+		return nil
+	})
+
+	for token, data := range raw {
+		if err := b.Put([]byte(HashToken(token)), data); err != nil {
+			return err
+		}
+		if err := b.Delete([]byte(token)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//indexUserRenewTokens adds renew tokens stored before user index was introduced into the index
+func indexUserRenewTokens(tx *bolt.Tx) error {
+	index := tx.Bucket([]byte(userRenewTokensBucket))
+
+	return tx.Bucket([]byte(renewTokensBucket)).ForEach(func(k, v []byte) error {
+		t, err := decodeRenewToken(string(k), v)
+		if err != nil {
+			return nil
+		}
+		return index.Put(userTokenKey(t.Email, t.Digest), nil)
+	})
+}
+
+//assignUserIDs moves users stored by email under generated IDs and indexes their emails
+func assignUserIDs(tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(userBucket))
+	byEmail := make(map[string]User)
+
+	err := b.ForEach(func(k, v []byte) error {
+		var user User
+		if err := json.Unmarshal(v, &user); err != nil {
+			return fmt.Errorf("user '%s': %s", k, err.Error())
+		}
+		if user.ID == "" {
+			byEmail[string(k)] = user
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	emails := tx.Bucket([]byte(userEmailsBucket))
+	for key, user := range byEmail {
+		user.ID = newUserID()
+		if err := b.Delete([]byte(key)); err != nil {
+			return err
+		}
+		if err := putUser(tx, &user); err != nil {
+			return err
+		}
+		if err := emails.Put([]byte(user.Email), []byte(user.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//canonicalizeEmails replaces emails of users with their canonical form without provider rules, so migration
+//doesn't depend on settings. Users whose emails have the same canonical form are left unchanged and reported,
+//merging accounts is up to administrator. Renew tokens are issued for email, so users whose email
+//is changed have to log in again
+func canonicalizeEmails(tx *bolt.Tx) error {
+	byCanonical := make(map[string][]User)
+	err := tx.Bucket([]byte(userBucket)).ForEach(func(k, v []byte) error {
+		var user User
+		if err := json.Unmarshal(v, &user); err != nil {
+			return fmt.Errorf("user '%s': %s", k, err.Error())
+		}
+		canonical := canonicalEmail(user.Email, false)
+		byCanonical[canonical] = append(byCanonical[canonical], user)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	emails := tx.Bucket([]byte(userEmailsBucket))
+	for canonical, users := range byCanonical {
+		if len(users) > 1 {
+			ids := make([]string, 0, len(users))
+			for _, user := range users {
+				ids = append(ids, user.ID)
+			}
+			sort.Strings(ids)
+			log.Printf("Email collision: users %s have emails with canonical form %s, they are left unchanged",
+				strings.Join(ids, ", "), canonical)
+			continue
+		}
+
+		user := users[0]
+		if user.Email == canonical {
+			continue
+		}
+		if err := deleteUserRenewTokens(tx, user.Email); err != nil {
+			return err
+		}
+		if err := emails.Delete([]byte(user.Email)); err != nil {
+			return err
+		}
+		if err := emails.Put([]byte(canonical), []byte(user.ID)); err != nil {
+			return err
+		}
+		user.Email = canonical
+		if err := putUser(tx, &user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//indexUserNicknames adds nicknames of users into nickname index. Users whose nicknames differ in case only
+//are left out of the index and reported, they log in by email. Reserved nicknames users already have are kept
+func indexUserNicknames(tx *bolt.Tx) error {
+	byNickname := make(map[string][]string)
+	err := tx.Bucket([]byte(userBucket)).ForEach(func(k, v []byte) error {
+		var user User
+		if err := json.Unmarshal(v, &user); err != nil {
+			return fmt.Errorf("user '%s': %s", k, err.Error())
+		}
+		if nickname := nicknameKey(user.Nickname); nickname != "" {
+			byNickname[nickname] = append(byNickname[nickname], user.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	nicknames := tx.Bucket([]byte(userNicknamesBucket))
+	for nickname, ids := range byNickname {
+		if len(ids) > 1 {
+			sort.Strings(ids)
+			log.Printf("Nickname collision: users %s have nickname %s, it isn't indexed", strings.Join(ids, ", "), nickname)
+			continue
+		}
+		if err := nicknames.Put([]byte(nickname), []byte(ids[0])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//indexRenewTokensByUserID sets owner ID of renew tokens issued before sessions were keyed by user ID and rebuilds
+//user index with IDs. Tokens of emails which don't belong to any user are left out of the index
+func indexRenewTokensByUserID(tx *bolt.Tx) error {
+	index := tx.Bucket([]byte(userRenewTokensBucket))
+	var stale [][]byte
+	index.ForEach(func(k, v []byte) error {
+		stale = append(stale, append([]byte(nil), k...))
+		return nil
+	})
+	for _, k := range stale {
+		if err := index.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	b := tx.Bucket([]byte(renewTokensBucket))
+	emails := tx.Bucket([]byte(userEmailsBucket))
+	owned := make(map[string]RenewToken)
+	b.ForEach(func(k, v []byte) error {
+		t, err := decodeRenewToken(string(k), v)
+		if err != nil {
+			return nil
+		}
+		if t.UserID == "" {
+			id := emails.Get([]byte(t.Email))
+			if id == nil {
+				return nil
+			}
+			t.UserID = string(id)
+		}
+		owned[t.Digest] = *t
+		return nil
+	})
+
+	for digest, t := range owned {
+		data, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(digest), data); err != nil {
+			return err
+		}
+		if err := index.Put(userTokenKey(t.UserID, digest), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//indexRenewTokensByFamily adds renew tokens stored before family index was introduced into the index
+func indexRenewTokensByFamily(tx *bolt.Tx) error {
+	index := tx.Bucket([]byte(familyRenewTokensBucket))
+
+	return tx.Bucket([]byte(renewTokensBucket)).ForEach(func(k, v []byte) error {
+		t, err := decodeRenewToken(string(k), v)
+		if err != nil {
+			return nil
+		}
+		return index.Put(familyTokenKey(t.Family, t.Digest), nil)
+	})
+}
@@ -0,0 +1,46 @@
+package store
+
+import "strings"
+
+//reservedNicknames can't be taken on registration, they may be confused with service accounts
+var reservedNicknames = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"root":          true,
+	"system":        true,
+	"support":       true,
+	"security":      true,
+	"moderator":     true,
+	"help":          true,
+	"info":          true,
+	"noreply":       true,
+	"postmaster":    true,
+	"webmaster":     true,
+	"go-auth":       true,
+}
+
+//ReserveNicknames adds nicknames to the reserved ones. Users who already have them keep them
+func ReserveNicknames(nicknames ...string) {
+	for _, nickname := range nicknames {
+		if key := nicknameKey(nickname); key != "" {
+			reservedNicknames[key] = true
+		}
+	}
+}
+
+//nicknameKey returns form of nickname used to check uniqueness, nicknames differing in case only are the same
+func nicknameKey(nickname string) string {
+	return strings.ToLower(strings.TrimSpace(nickname))
+}
+
+//nicknameError returns validation message for nickname, empty if nickname may be taken.
+//Nicknames can't contain @, so login identifier with it is always email
+func nicknameError(nickname string) string {
+	if strings.Contains(nickname, "@") {
+		return "Nickname can't contain @"
+	}
+	if reservedNicknames[nicknameKey(nickname)] {
+		return "Nickname is reserved"
+	}
+	return ""
+}
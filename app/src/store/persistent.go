@@ -1,79 +1,90 @@
 package store
 
 import (
-	"encoding/binary"
-	"encoding/json"
-	"fmt"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"log"
-	"time"
+	"strings"
 
 	"github.com/asaskevich/govalidator"
-	"github.com/boltdb/bolt"
 	"golang.org/x/crypto/bcrypt"
 )
 
-const userBucket = "Users"
-const renewTokensBucket = "RenewTokens"
 const cryptingCost = 12
 
-var database *bolt.DB
-
-func init() {
-	govalidator.TagMap["unique"] = govalidator.Validator(func(email string) bool {
-		return !userExists(email)
-	})
+//ErrUserNotFound returned when user with such email doesn't exist
+var ErrUserNotFound = errors.New("User not found")
+
+//ErrEmailTaken returned when user is created or email is changed with email of another user
+var ErrEmailTaken = errors.New("Email is already taken")
+
+//ErrNicknameTaken returned when user is created with nickname of another user
+var ErrNicknameTaken = errors.New("Nickname is already taken")
+
+//UserStore keeps users by ID and indexes them by email and nickname. Nicknames differing in case only
+//are the same, empty nickname isn't indexed. Implementations must be safe for concurrent use
+type UserStore interface {
+	//Create writes new user with ID and hashed password. Returns ErrEmailTaken if another user has the email
+	//and ErrNicknameTaken if another user has the nickname, checks and insert are atomic
+	Create(user *User) error
+	//GetUserByID returns user with the ID, false if there is no such user
+	GetUserByID(id string) (bool, *User)
+	//GetUserByEmail returns user with the email, false if there is no such user
+	GetUserByEmail(email string) (bool, *User)
+	//GetUserByNickname returns user with the nickname in any case, false if there is no such user
+	GetUserByNickname(nickname string) (bool, *User)
+	//SetEmail replaces email of the user with the ID. Returns ErrUserNotFound if there is no such user
+	//and ErrEmailTaken if another user has the email
+	SetEmail(id string, email string) error
+	//SetPassword replaces hashed password of the user with the ID, returns ErrUserNotFound if there is no such user
+	SetPassword(id string, hashedPwd string) error
 }
 
-//OpenDatabase opens connection to the persistent DB
-func OpenDatabase(store string) error {
-	db, err := bolt.Open(store, 0600, nil)
-	if err != nil {
-		return err
-	}
-	database = db
-
-	return CreateDefaultBacket()
+//TokenStore keeps renew tokens by digest. Implementations must be safe for concurrent use
+type TokenStore interface {
+	//AddRenewTokens writes renew tokens at once, existing tokens with the same digests are replaced
+	AddRenewTokens(tokens []RenewToken) error
+	//GetRenewToken returns unexpired renew token by digest
+	GetRenewToken(digest string) (bool, *RenewToken)
+	//RetireRenewToken marks renew token as exchanged. Returns false if token is unknown or already retired
+	RetireRenewToken(digest string) (bool, error)
+	//DeleteRenewToken deletes renew token by digest
+	DeleteRenewToken(digest string) error
+	//DeleteRenewFamily deletes all renew tokens of the family
+	DeleteRenewFamily(family string) error
+	//GetAllRenewTokens returns all unexpired renew tokens
+	GetAllRenewTokens() []RenewToken
+	//ClearRenewTokens deletes renew tokens expired before now. Returns deleted tokens
+	ClearRenewTokens(now int64) ([]RenewToken, error)
+	//GetUserRenewTokens returns unexpired renew tokens of the user with the ID
+	GetUserRenewTokens(userID string) []RenewToken
+	//DeleteUserRenewTokens deletes all renew tokens of the user with the ID
+	DeleteUserRenewTokens(userID string) error
+	//AddRevokedToken writes ID of revoked auth token which expires at expireAt
+	AddRevokedToken(id string, expireAt int64) error
+	//IsTokenRevoked returns true if auth token with the ID was revoked
+	IsTokenRevoked(id string) (bool, error)
+	//ClearRevokedTokens deletes IDs of revoked auth tokens expired before now
+	ClearRevokedTokens(now int64) error
 }
 
-//CreateDefaultBacket create default backet for correct DB work
-func CreateDefaultBacket() error {
-	return database.Update(func(tx *bolt.Tx) error {
-
-		if _, err := tx.CreateBucketIfNotExists([]byte(userBucket)); err != nil {
-			return err
-		}
-
-		if _, err := tx.CreateBucketIfNotExists([]byte(renewTokensBucket)); err != nil {
-			return err
-		}
-
-		return nil
-	})
-}
-
-//CloseDatabase closes connection and release all resources
-func CloseDatabase() {
-	database.Close()
-}
-
-//DropDatabase cleare all data form database
-func DropDatabase() error {
-	return database.Update(func(tx *bolt.Tx) error {
-		if err := tx.DeleteBucket([]byte(userBucket)); err != nil {
-			return err
-		}
-
-		if err := tx.DeleteBucket([]byte(renewTokensBucket)); err != nil {
-			return err
-		}
+var userStore UserStore
+var tokenStore TokenStore
 
-		return nil
-	})
+//UseStores sets stores of users and renew tokens used by package functions. OpenDatabase uses bolt for both
+func UseStores(users UserStore, tokens TokenStore) {
+	userStore = users
+	tokenStore = tokens
 }
 
-//User is datastruct for user with credentials
+//User is datastruct for user with credentials. ID is generated on creation and never changes,
+//so email may be changed
 type User struct {
-	Email     string `json:"email" valid:"email,required,unique"`
+	ID        string `json:"id" valid:"-"`
+	Email     string `json:"email" valid:"email,required"`
 	Password  string `json:"password" valid:"stringlength(6|64),required"`
 	HashedPwd string `json:"hashed_pwd"`
 	Nickname  string `json:"nickname" valid:"stringlength(2|100)"`
@@ -83,12 +94,19 @@ type User struct {
 	validationErrors map[string]string
 }
 
-//Create is a method for create user into the store
+//Create is a method for create user into the store. Email is stored in canonical form. Uniqueness of email
+//and nickname is checked by the store when user is inserted, so if one of them is taken user is not valid
+//and err is ErrEmailTaken or ErrNicknameTaken
 func (user *User) Create() (valid bool, validationErrors map[string]string, err error) {
+	user.Email = CanonicalEmail(user.Email)
+	user.Nickname = strings.TrimSpace(user.Nickname)
 	if valid, err = govalidator.ValidateStruct(user); !valid {
 		validationErrors = govalidator.ErrorsByField(err)
 		return
 	}
+	if message := nicknameError(user.Nickname); message != "" {
+		return false, map[string]string{"nickname": message}, nil
+	}
 
 	cryptedPwd, err := bcrypt.GenerateFromPassword([]byte(user.Password), cryptingCost)
 	if err != nil {
@@ -97,122 +115,175 @@ func (user *User) Create() (valid bool, validationErrors map[string]string, err
 	}
 	user.HashedPwd = string(cryptedPwd)
 	user.Password = ""
+	user.ID = newUserID()
 
-	data, err := json.Marshal(user)
-	if err != nil {
-		return
+	switch err = userStore.Create(user); err {
+	case ErrEmailTaken:
+		return false, map[string]string{"email": err.Error()}, err
+	case ErrNicknameTaken:
+		return false, map[string]string{"nickname": err.Error()}, err
 	}
-
-	err = database.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(userBucket))
-
-		return b.Put([]byte(user.Email), data)
-	})
 	return
 }
 
-//GetUserByEmail get user by email
+//GetUserByID get user by ID
+func GetUserByID(id string) (bool, *User) {
+	return userStore.GetUserByID(id)
+}
+
+//GetUserByEmail get user by exact email and then by its canonical form. Exact email goes first, so users left
+//unchanged by email collision aren't hidden by the colliding user with canonical email. Users stored before
+//provider rules were enabled are found by case insensitive email
 func GetUserByEmail(email string) (bool, *User) {
-	var user User
-	var found bool
-	err := database.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(userBucket))
-		data := b.Get([]byte(email))
-		if data == nil {
-			return nil
+	var user *User
+	var tried []string
+	for _, key := range []string{strings.TrimSpace(email), CanonicalEmail(email), canonicalEmail(email, false)} {
+		if contains(tried, key) {
+			continue
 		}
-		found = true
-		if err := json.Unmarshal(data, &user); err != nil {
-			return err
+		tried = append(tried, key)
+
+		var found bool
+		if found, user = userStore.GetUserByEmail(key); found {
+			return true, user
 		}
-		return nil
-	})
+	}
+	return false, user
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+//GetUserByNickname get user by nickname in any case
+func GetUserByNickname(nickname string) (bool, *User) {
+	if nickname = strings.TrimSpace(nickname); nickname == "" {
+		return false, &User{}
+	}
+	return userStore.GetUserByNickname(nickname)
+}
+
+//GetUserByLogin get user by login identifier, which is email if it contains @ and nickname otherwise
+func GetUserByLogin(login string) (bool, *User) {
+	if strings.Contains(login, "@") {
+		return GetUserByEmail(login)
+	}
+	return GetUserByNickname(login)
+}
+
+//ChangeEmail replaces email of the user with the ID by canonical form of email
+func ChangeEmail(id string, email string) error {
+	return userStore.SetEmail(id, CanonicalEmail(email))
+}
+
+//newUserID generates random URL safe user ID
+func newUserID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+//ChangePassword replaces password of the user with the ID
+func ChangePassword(id string, password string) error {
+	cryptedPwd, err := bcrypt.GenerateFromPassword([]byte(password), cryptingCost)
 	if err != nil {
-		log.Println("Error while getting user by email: ", err.Error())
+		return err
 	}
-	return found, &user
+	return userStore.SetPassword(id, string(cryptedPwd))
+}
+
+//RenewToken structure with base token data. Tokens are stored by SHA-256 digest,
+//so database copy can't be used to replay sessions. Tokens belong to user with UserID,
+//Email is the one user had when session started
+type RenewToken struct {
+	Digest      string `json:"-"`
+	UserID      string `json:"user_id,omitempty"`
+	Email       string `json:"email"`
+	Family      string `json:"family"`
+	ExpireAt    int64  `json:"expire_at"`
+	MaxExpireAt int64  `json:"max_expire_at,omitempty"`
+	Retired     bool   `json:"retired"`
+	CreatedAt   int64  `json:"created_at,omitempty"`
+	RefreshedAt int64  `json:"refreshed_at,omitempty"`
+	IP          string `json:"ip,omitempty"`
+	UserAgent   string `json:"user_agent,omitempty"`
+}
+
+//HashToken returns hex encoded SHA-256 digest of the token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
 //AddRenewToken adds renew token to database
-func AddRenewToken(token string, expireAt int64) error {
-	err := database.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(renewTokensBucket))
+func AddRenewToken(token RenewToken) error {
+	return tokenStore.AddRenewTokens([]RenewToken{token})
+}
 
-		binaries := make([]byte, 8)
-		binary.LittleEndian.PutUint64(binaries, uint64(expireAt))
+//AddRenewTokens adds renew tokens to database in one transaction
+func AddRenewTokens(tokens []RenewToken) error {
+	return tokenStore.AddRenewTokens(tokens)
+}
 
-		return b.Put([]byte(token), binaries)
-	})
-	return err
+//DeleteRenewToken delete renew token from database by digest
+func DeleteRenewToken(digest string) error {
+	return tokenStore.DeleteRenewToken(digest)
 }
 
-//DeleteRenewToken delete renew token from database
-func DeleteRenewToken(token string) error {
-	err := database.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(renewTokensBucket))
+//RetireRenewToken marks renew token with digest as exchanged. Check and update are done atomically,
+//so it returns false if token is unknown or already retired
+func RetireRenewToken(digest string) (bool, error) {
+	return tokenStore.RetireRenewToken(digest)
+}
 
-		return b.Delete([]byte(token))
-	})
-	return err
+//DeleteRenewFamily deletes all renew tokens of the family
+func DeleteRenewFamily(family string) error {
+	return tokenStore.DeleteRenewFamily(family)
 }
 
-//RenewToken structure with base token data
-type RenewToken struct {
-	token    string
-	expireAt int64
+//GetRenewToken get unexpired renew token from database by digest
+func GetRenewToken(digest string) (bool, *RenewToken) {
+	return tokenStore.GetRenewToken(digest)
 }
 
 //GetAllRenewTokens returns all renew tokens
 func GetAllRenewTokens() []RenewToken {
-	tokens := make([]RenewToken, 0, 10)
-	now := time.Now().Unix()
-	database.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(renewTokensBucket))
-		c := b.Cursor()
-
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-
-			t := RenewToken{
-				token:    string(k),
-				expireAt: int64(binary.LittleEndian.Uint64(v)),
-			}
-
-			if now < t.expireAt {
-				tokens = append(tokens, t)
-			}
-		}
-		return nil
-	})
-	return tokens
-}
-
-//ClearRenewTokens deletes all expired tokens from database
-func ClearRenewTokens() error {
-	now := time.Now().Unix()
-	return database.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(renewTokensBucket))
-		c := b.Cursor()
-
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			fmt.Printf("key=%s, value=%s\n", k, v)
-
-			if now > int64(binary.LittleEndian.Uint64(v)) {
-				if err := b.Delete(k); err != nil {
-					return err
-				}
-			}
-		}
-		return nil
-	})
-}
-
-func userExists(email string) bool {
-	var exist bool
-	database.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(userBucket))
-		data := b.Get([]byte(email))
-		exist = data != nil
-		return nil
-	})
-	return exist
+	return tokenStore.GetAllRenewTokens()
+}
+
+//ClearRenewTokens deletes all tokens expired before now from database. Returns deleted tokens
+func ClearRenewTokens(now int64) ([]RenewToken, error) {
+	return tokenStore.ClearRenewTokens(now)
+}
+
+//GetUserRenewTokens returns all unexpired renew tokens of the user with the ID
+func GetUserRenewTokens(userID string) []RenewToken {
+	return tokenStore.GetUserRenewTokens(userID)
+}
+
+//DeleteUserRenewTokens deletes all renew tokens of the user with the ID
+func DeleteUserRenewTokens(userID string) error {
+	return tokenStore.DeleteUserRenewTokens(userID)
+}
+
+//AddRevokedToken keeps ID of revoked auth token till its expiration
+func AddRevokedToken(id string, expireAt int64) error {
+	return tokenStore.AddRevokedToken(id, expireAt)
+}
+
+//IsTokenRevoked checks if auth token with the ID was revoked
+func IsTokenRevoked(id string) (bool, error) {
+	return tokenStore.IsTokenRevoked(id)
+}
+
+//ClearRevokedTokens deletes IDs of revoked auth tokens expired before now from database
+func ClearRevokedTokens(now int64) error {
+	return tokenStore.ClearRevokedTokens(now)
 }
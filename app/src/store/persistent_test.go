@@ -1,9 +1,23 @@
 package store
 
 import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/boltdb/bolt"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -62,6 +76,128 @@ func (suite *RegistrationTestSuite) TestUserSave_Twice() {
 	suite.False(ok)
 }
 
+func (suite *RegistrationTestSuite) TestUserSave_CaseInsensitiveEmail() {
+	user := User{Email: " Jhon.Doe@TestMail.com ", Password: "!strongPwd"}
+	ok, _, err := user.Create()
+	suite.True(ok)
+	suite.Nil(err)
+	suite.Equal("jhon.doe@testmail.com", user.Email)
+
+	found, stored := GetUserByEmail("JHON.DOE@testmail.COM")
+	suite.True(found)
+	suite.Equal(user.ID, stored.ID)
+
+	duplicate := User{Email: "jhon.doe@TESTMAIL.com", Password: "!strongPwd"}
+	ok, _, err = duplicate.Create()
+	suite.False(ok)
+	suite.Equal(ErrEmailTaken, err)
+}
+
+func (suite *RegistrationTestSuite) TestGetUserByEmail_WithCollision() {
+	suite.Nil(userStore.Create(&User{ID: "bob1", Email: "Bob@Example.com", HashedPwd: "hash"}))
+	suite.Nil(userStore.Create(&User{ID: "bob2", Email: "bob@example.com", HashedPwd: "hash"}))
+
+	found, user := GetUserByEmail(" Bob@Example.com ")
+	suite.True(found)
+	suite.Equal("bob1", user.ID)
+	found, user = GetUserByEmail("bob@example.com")
+	suite.True(found)
+	suite.Equal("bob2", user.ID)
+	found, user = GetUserByEmail("BOB@example.com")
+	suite.True(found)
+	suite.Equal("bob2", user.ID)
+}
+
+func (suite *RegistrationTestSuite) TestUserSave_WithProviderRules() {
+	defer UseProviderRules(false)
+
+	legacy := User{Email: "Jhon.Doe+news@googlemail.com", Password: "!strongPwd"}
+	ok, _, _ := legacy.Create()
+	suite.True(ok)
+
+	UseProviderRules(true)
+	found, stored := GetUserByEmail("Jhon.Doe+news@googlemail.com")
+	suite.True(found, "user registered before rules are enabled")
+	suite.Equal(legacy.ID, stored.ID)
+
+	user := User{Email: "j.h.o.n.d.o.e@gmail.com", Password: "!strongPwd"}
+	ok, _, _ = user.Create()
+	suite.True(ok)
+	suite.Equal("jhondoe@gmail.com", user.Email)
+
+	duplicate := User{Email: "JhonDoe+spam@googlemail.com", Password: "!strongPwd"}
+	ok, _, err := duplicate.Create()
+	suite.False(ok)
+	suite.Equal(ErrEmailTaken, err)
+	found, stored = GetUserByEmail("jhon.doe+other@gmail.com")
+	suite.True(found)
+	suite.Equal(user.ID, stored.ID)
+}
+
+func (suite *RegistrationTestSuite) TestUserSave_WithNickname() {
+	user := User{Email: "jhondoe@testmail.com", Password: "!strongPwd", Nickname: " JD "}
+	ok, _, _ := user.Create()
+	suite.True(ok)
+	suite.Equal("JD", user.Nickname)
+
+	found, stored := GetUserByNickname("jd")
+	suite.True(found)
+	suite.Equal(user.ID, stored.ID)
+	found, stored = GetUserByLogin("Jd")
+	suite.True(found)
+	suite.Equal(user.ID, stored.ID)
+	found, _ = GetUserByNickname("")
+	suite.False(found)
+
+	duplicate := User{Email: "jhon@testmail.com", Password: "!strongPwd", Nickname: "jd"}
+	ok, validationErrors, err := duplicate.Create()
+	suite.False(ok)
+	suite.Equal(ErrNicknameTaken, err)
+	suite.Contains(validationErrors, "nickname")
+	found, _ = GetUserByEmail("jhon@testmail.com")
+	suite.False(found)
+
+	for _, nickname := range []string{"Admin", "jhon@doe"} {
+		invalid := User{Email: "jhon@testmail.com", Password: "!strongPwd", Nickname: nickname}
+		ok, validationErrors, err = invalid.Create()
+		suite.False(ok, nickname)
+		suite.Nil(err)
+		suite.Contains(validationErrors, "nickname")
+	}
+}
+
+func (suite *RegistrationTestSuite) TestUserSave_Concurrently() {
+	users := make([]User, 4)
+	results := make([]error, len(users))
+	var wg sync.WaitGroup
+	wg.Add(len(users))
+	for i := range users {
+		users[i] = User{Email: "jhondoe@testmail.com", Password: fmt.Sprintf("!strongPwd%v", i)}
+		go func(n int) {
+			defer wg.Done()
+			ok, validationErrors, err := users[n].Create()
+			if !ok {
+				suite.Contains(validationErrors, "email")
+			}
+			results[n] = err
+		}(i)
+	}
+	wg.Wait()
+
+	_, saved := GetUserByEmail("jhondoe@testmail.com")
+	var created int
+	for i, err := range results {
+		if err == nil {
+			created++
+			suite.Equal(users[i].ID, saved.ID)
+			suite.Equal(users[i].HashedPwd, saved.HashedPwd)
+		} else {
+			suite.Equal(ErrEmailTaken, err)
+		}
+	}
+	suite.Equal(1, created)
+}
+
 func (suite *RegistrationTestSuite) TestUserSave_CheckInDatabase() {
 	user := User{
 		Email:     "jhondoe@testmail.com",
@@ -120,3 +256,651 @@ func (suite *RegistrationTestSuite) TestUserCreate_WithTryToSetHashedPwd() {
 	suite.NotEqual("!strongPwd", user.HashedPwd)
 	suite.Empty(user.Password)
 }
+
+func (suite *RegistrationTestSuite) TestGetRenewToken() {
+	AddRenewToken(RenewToken{Digest: "valid_token", Email: "jhondoe@testmail.com", ExpireAt: time.Now().Add(time.Minute).Unix()})
+	AddRenewToken(RenewToken{Digest: "expired_token", ExpireAt: time.Now().Add(-time.Minute).Unix()})
+
+	found, token := GetRenewToken("valid_token")
+	suite.True(found)
+	suite.Equal("valid_token", token.Digest)
+	suite.Equal("jhondoe@testmail.com", token.Email)
+
+	found, _ = GetRenewToken("expired_token")
+	suite.False(found)
+
+	found, _ = GetRenewToken("unknown_token")
+	suite.False(found)
+}
+
+func (suite *RegistrationTestSuite) TestRenewTokenFamily() {
+	expireAt := time.Now().Add(time.Minute).Unix()
+	AddRenewToken(RenewToken{Digest: "first_token", Family: "family", ExpireAt: expireAt})
+	AddRenewToken(RenewToken{Digest: "second_token", Family: "family", ExpireAt: expireAt})
+	AddRenewToken(RenewToken{Digest: "another_token", Family: "another_family", ExpireAt: expireAt})
+
+	retired, err := RetireRenewToken("first_token")
+	suite.Nil(err)
+	suite.True(retired)
+	retired, err = RetireRenewToken("first_token")
+	suite.Nil(err)
+	suite.False(retired)
+	retired, _ = RetireRenewToken("unknown_token")
+	suite.False(retired)
+	_, token := GetRenewToken("first_token")
+	suite.True(token.Retired)
+	_, token = GetRenewToken("second_token")
+	suite.False(token.Retired)
+
+	suite.Nil(DeleteRenewFamily("family"))
+	suite.Len(GetAllRenewTokens(), 1)
+	found, _ := GetRenewToken("another_token")
+	suite.True(found)
+}
+
+func (suite *RegistrationTestSuite) TestRenewToken_WithLegacyRecord() {
+	expireAt := time.Now().Add(time.Minute).Unix()
+	database.Update(func(tx *bolt.Tx) error {
+		binaries := make([]byte, 8)
+		binary.LittleEndian.PutUint64(binaries, uint64(expireAt))
+		return tx.Bucket([]byte(renewTokensBucket)).Put([]byte("legacy_token"), binaries)
+	})
+
+	found, token := GetRenewToken("legacy_token")
+	suite.True(found)
+	suite.Equal(expireAt, token.ExpireAt)
+}
+
+func (suite *RegistrationTestSuite) TestHashRawRenewTokens() {
+	raw := "header.payload.signature"
+	database.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(renewTokensBucket)).Put([]byte(raw), []byte(`{"expire_at":9999999999}`))
+	})
+
+	suite.Nil(database.Update(hashRawRenewTokens))
+
+	found, _ := GetRenewToken(raw)
+	suite.False(found)
+
+	found, token := GetRenewToken(HashToken(raw))
+	suite.True(found)
+	suite.Equal(HashToken(raw), token.Digest)
+	suite.Len(token.Digest, 64)
+}
+
+func (suite *RegistrationTestSuite) TestUserRenewTokens() {
+	expireAt := time.Now().Add(time.Minute).Unix()
+	AddRenewTokens([]RenewToken{
+		{Digest: "first_token", UserID: "jhon_id", Email: "jhondoe@testmail.com", Family: "family", ExpireAt: expireAt},
+		{Digest: "second_token", UserID: "jhon_id", Email: "jhondoe@testmail.com", Family: "another_family", ExpireAt: expireAt},
+		{Digest: "third_token", UserID: "jhon_id", Email: "jhondoe@testmail.com", Family: "third_family", ExpireAt: expireAt},
+		{Digest: "another_token", UserID: "another_id", Email: "jhondoe@testmail.co", Family: "family", ExpireAt: expireAt},
+	})
+
+	suite.Len(GetUserRenewTokens("jhon_id"), 3)
+	suite.Len(GetUserRenewTokens("another_id"), 1)
+
+	suite.Nil(DeleteRenewToken("third_token"))
+	suite.Nil(DeleteRenewFamily("another_family"))
+	tokens := GetUserRenewTokens("jhon_id")
+	suite.Len(tokens, 1)
+	suite.Equal("first_token", tokens[0].Digest)
+
+	suite.Nil(DeleteUserRenewTokens("jhon_id"))
+	suite.Len(GetUserRenewTokens("jhon_id"), 0)
+	suite.Len(GetAllRenewTokens(), 1)
+	found, _ := GetRenewToken("another_token")
+	suite.True(found)
+}
+
+func (suite *RegistrationTestSuite) TestIndexUserRenewTokens() {
+	database.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(renewTokensBucket)).Put([]byte("some_token"), []byte(fmt.Sprintf(
+			`{"email":"jhondoe@testmail.com","expire_at":%d}`, time.Now().Add(time.Minute).Unix())))
+	})
+	suite.Len(GetUserRenewTokens("jhondoe@testmail.com"), 0)
+
+	suite.Nil(database.Update(indexUserRenewTokens))
+	suite.Len(GetUserRenewTokens("jhondoe@testmail.com"), 1)
+}
+
+func (suite *RegistrationTestSuite) TestIndexRenewTokensByUserID() {
+	user := User{Email: "jhondoe@testmail.com", Password: "!strongPwd"}
+	user.Create()
+	database.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(renewTokensBucket))
+		expireAt := time.Now().Add(time.Minute).Unix()
+		b.Put([]byte("some_token"), []byte(fmt.Sprintf(`{"email":"jhondoe@testmail.com","expire_at":%d}`, expireAt)))
+		return b.Put([]byte("orphan_token"), []byte(fmt.Sprintf(`{"email":"unknown@testmail.com","expire_at":%d}`, expireAt)))
+	})
+	suite.Len(GetUserRenewTokens(user.ID), 0)
+
+	suite.Nil(database.Update(indexRenewTokensByUserID))
+	tokens := GetUserRenewTokens(user.ID)
+	suite.Len(tokens, 1)
+	suite.Equal(user.ID, tokens[0].UserID)
+	found, _ := GetRenewToken("orphan_token")
+	suite.True(found)
+}
+
+func (suite *RegistrationTestSuite) TestIndexRenewTokensByFamily() {
+	expireAt := time.Now().Add(time.Minute).Unix()
+	database.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(renewTokensBucket))
+		b.Put([]byte("some_token"), []byte(fmt.Sprintf(`{"user_id":"jhon_id","family":"family","expire_at":%d}`, expireAt)))
+		return b.Put([]byte("another_token"), []byte(fmt.Sprintf(`{"user_id":"jhon_id","family":"another_family","expire_at":%d}`, expireAt)))
+	})
+
+	suite.Nil(database.Update(indexRenewTokensByFamily))
+	suite.Nil(DeleteRenewFamily("family"))
+	found, _ := GetRenewToken("some_token")
+	suite.False(found)
+	found, _ = GetRenewToken("another_token")
+	suite.True(found)
+
+	database.View(func(tx *bolt.Tx) error {
+		suite.Nil(tx.Bucket([]byte(familyRenewTokensBucket)).Get(familyTokenKey("family", "some_token")))
+		suite.NotNil(tx.Bucket([]byte(familyRenewTokensBucket)).Get(familyTokenKey("another_family", "another_token")))
+		return nil
+	})
+}
+
+func (suite *RegistrationTestSuite) TestChangePassword() {
+	user := User{Email: "jhondoe@testmail.com", Password: "!strongPwd"}
+	user.Create()
+
+	suite.Nil(ChangePassword(user.ID, "!newStrongPwd"))
+	_, changed := GetUserByEmail("jhondoe@testmail.com")
+	suite.NotEqual(user.HashedPwd, changed.HashedPwd)
+
+	suite.Equal(ErrUserNotFound, ChangePassword("unknown_id", "!newStrongPwd"))
+}
+
+//openStores opens each store implementation on fresh database. Returned function releases them
+func openStores(t *testing.T) (map[string]interface {
+	UserStore
+	TokenStore
+}, func()) {
+	dir, err := ioutil.TempDir("", "stores")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	boltDB, err := bolt.Open(filepath.Join(dir, "store.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	boltStore, err := NewBoltStore(boltDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDB, err := sql.Open("sqlite3", filepath.Join(dir, "store.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	sqlStore, err := NewSQLStore(sqlDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := map[string]interface {
+		UserStore
+		TokenStore
+	}{
+		"bolt":   boltStore,
+		"memory": NewMemoryStore(),
+		"sql":    sqlStore,
+	}
+	return stores, func() {
+		boltDB.Close()
+		sqlDB.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestStores_Users(t *testing.T) {
+	stores, release := openStores(t)
+	defer release()
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			user := User{ID: "user_id", Email: "jhondoe@testmail.com", HashedPwd: "hash", Nickname: "JD", FirstName: "Jhon", LastName: "Doe"}
+			assert.Nil(t, s.Create(&user))
+
+			found, saved := s.GetUserByEmail("jhondoe@testmail.com")
+			assert.True(t, found)
+			assert.Equal(t, "user_id", saved.ID)
+			assert.Equal(t, user.Email, saved.Email)
+			assert.Equal(t, "hash", saved.HashedPwd)
+			assert.Equal(t, "JD", saved.Nickname)
+			assert.Equal(t, "Jhon", saved.FirstName)
+			assert.Equal(t, "Doe", saved.LastName)
+
+			found, _ = s.GetUserByEmail("unknown@testmail.com")
+			assert.False(t, found)
+
+			assert.Nil(t, s.SetPassword("user_id", "new_hash"))
+			_, saved = s.GetUserByEmail("jhondoe@testmail.com")
+			assert.Equal(t, "new_hash", saved.HashedPwd)
+			assert.Equal(t, ErrUserNotFound, s.SetPassword("unknown_id", "new_hash"))
+
+			another := User{ID: "another_id", Email: "another@testmail.com", HashedPwd: "hash"}
+			assert.Nil(t, s.Create(&another))
+			duplicate := User{ID: "duplicate_id", Email: "another@testmail.com", HashedPwd: "duplicate_hash"}
+			assert.Equal(t, ErrEmailTaken, s.Create(&duplicate))
+			found, _ = s.GetUserByID("duplicate_id")
+			assert.False(t, found)
+			assert.Equal(t, ErrEmailTaken, s.SetEmail("user_id", "another@testmail.com"))
+			assert.Equal(t, ErrUserNotFound, s.SetEmail("unknown_id", "jhon@testmail.com"))
+
+			assert.Nil(t, s.SetEmail("user_id", "jhon@testmail.com"))
+			found, _ = s.GetUserByEmail("jhondoe@testmail.com")
+			assert.False(t, found)
+			found, saved = s.GetUserByEmail("jhon@testmail.com")
+			assert.True(t, found)
+			assert.Equal(t, "user_id", saved.ID)
+			assert.Equal(t, "new_hash", saved.HashedPwd)
+			found, saved = s.GetUserByID("user_id")
+			assert.True(t, found)
+			assert.Equal(t, "jhon@testmail.com", saved.Email)
+			found, _ = s.GetUserByID("unknown_id")
+			assert.False(t, found)
+
+			found, saved = s.GetUserByNickname("jd")
+			assert.True(t, found)
+			assert.Equal(t, "user_id", saved.ID)
+			found, _ = s.GetUserByNickname("")
+			assert.False(t, found)
+			namesake := User{ID: "namesake_id", Email: "namesake@testmail.com", HashedPwd: "hash", Nickname: "jD"}
+			assert.Equal(t, ErrNicknameTaken, s.Create(&namesake))
+			found, _ = s.GetUserByEmail("namesake@testmail.com")
+			assert.False(t, found)
+			namesake.Nickname = ""
+			assert.Nil(t, s.Create(&namesake), "users without nickname")
+		})
+	}
+}
+
+func TestStores_CreateConcurrently(t *testing.T) {
+	stores, release := openStores(t)
+	defer release()
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			var created int32
+			var wg sync.WaitGroup
+			wg.Add(10)
+			for i := 0; i < 10; i++ {
+				go func(n int) {
+					defer wg.Done()
+					user := User{ID: fmt.Sprintf("user_%v", n), Email: "jhondoe@testmail.com", HashedPwd: fmt.Sprintf("hash_%v", n)}
+					err := s.Create(&user)
+					if err == nil {
+						atomic.AddInt32(&created, 1)
+					} else {
+						assert.Equal(t, ErrEmailTaken, err)
+					}
+				}(i)
+			}
+			wg.Wait()
+			assert.Equal(t, int32(1), created)
+
+			found, user := s.GetUserByEmail("jhondoe@testmail.com")
+			assert.True(t, found)
+			assert.Equal(t, "hash_"+strings.TrimPrefix(user.ID, "user_"), user.HashedPwd)
+		})
+	}
+}
+
+func TestStores_RenewTokens(t *testing.T) {
+	stores, release := openStores(t)
+	defer release()
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			expireAt := time.Now().Add(time.Minute).Unix()
+			assert.Nil(t, s.AddRenewTokens([]RenewToken{
+				{Digest: "first_token", UserID: "user_id", Email: "jhondoe@testmail.com", Family: "family", ExpireAt: expireAt, CreatedAt: 1, IP: "10.0.0.1"},
+				{Digest: "second_token", UserID: "user_id", Email: "jhondoe@testmail.com", Family: "family", ExpireAt: expireAt},
+				{Digest: "another_token", UserID: "user_id", Email: "jhondoe@testmail.com", Family: "another_family", ExpireAt: expireAt},
+				{Digest: "other_user_token", UserID: "other_id", Email: "other@testmail.com", Family: "other_family", ExpireAt: expireAt},
+				{Digest: "expired_token", UserID: "user_id", Email: "jhondoe@testmail.com", Family: "family", ExpireAt: time.Now().Add(-time.Minute).Unix()},
+			}))
+
+			found, token := s.GetRenewToken("first_token")
+			assert.True(t, found)
+			assert.Equal(t, RenewToken{Digest: "first_token", UserID: "user_id", Email: "jhondoe@testmail.com", Family: "family", ExpireAt: expireAt, CreatedAt: 1, IP: "10.0.0.1"}, *token)
+			found, _ = s.GetRenewToken("expired_token")
+			assert.False(t, found)
+			found, _ = s.GetRenewToken("unknown_token")
+			assert.False(t, found)
+
+			assert.Len(t, s.GetAllRenewTokens(), 4)
+			assert.Len(t, s.GetUserRenewTokens("user_id"), 3)
+
+			retired, err := s.RetireRenewToken("first_token")
+			assert.Nil(t, err)
+			assert.True(t, retired)
+			retired, _ = s.RetireRenewToken("first_token")
+			assert.False(t, retired)
+			retired, _ = s.RetireRenewToken("unknown_token")
+			assert.False(t, retired)
+			_, token = s.GetRenewToken("first_token")
+			assert.True(t, token.Retired)
+
+			cleared, err := s.ClearRenewTokens(time.Now().Add(-2 * time.Minute).Unix())
+			assert.Nil(t, err)
+			assert.Empty(t, cleared)
+			cleared, err = s.ClearRenewTokens(time.Now().Unix())
+			assert.Nil(t, err)
+			assert.Len(t, cleared, 1)
+			assert.Equal(t, "expired_token", cleared[0].Digest)
+
+			assert.Nil(t, s.DeleteRenewToken("second_token"))
+			assert.Nil(t, s.DeleteRenewFamily("family"))
+			assert.Len(t, s.GetUserRenewTokens("user_id"), 1)
+
+			assert.Nil(t, s.DeleteUserRenewTokens("user_id"))
+			assert.Empty(t, s.GetUserRenewTokens("user_id"))
+			tokens := s.GetAllRenewTokens()
+			assert.Len(t, tokens, 1)
+			assert.Equal(t, "other_user_token", tokens[0].Digest)
+		})
+	}
+}
+
+func TestStores_RevokedTokens(t *testing.T) {
+	stores, release := openStores(t)
+	defer release()
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			expireAt := time.Now().Add(time.Minute).Unix()
+			assert.Nil(t, s.AddRevokedToken("some_id", expireAt))
+			assert.Nil(t, s.AddRevokedToken("some_id", expireAt))
+			assert.Nil(t, s.AddRevokedToken("expired_id", time.Now().Add(-time.Minute).Unix()))
+
+			revoked, err := s.IsTokenRevoked("some_id")
+			assert.Nil(t, err)
+			assert.True(t, revoked)
+			revoked, err = s.IsTokenRevoked("unknown_id")
+			assert.Nil(t, err)
+			assert.False(t, revoked)
+
+			assert.Nil(t, s.ClearRevokedTokens(time.Now().Unix()))
+			revoked, _ = s.IsTokenRevoked("expired_id")
+			assert.False(t, revoked)
+			revoked, _ = s.IsTokenRevoked("some_id")
+			assert.True(t, revoked)
+
+			assert.Nil(t, s.ClearRevokedTokens(expireAt))
+			revoked, _ = s.IsTokenRevoked("some_id")
+			assert.True(t, revoked, "token is kept till its expiration")
+			assert.Nil(t, s.ClearRevokedTokens(expireAt+1))
+			revoked, _ = s.IsTokenRevoked("some_id")
+			assert.False(t, revoked)
+		})
+	}
+}
+
+func TestStores_RetireConcurrently(t *testing.T) {
+	stores, release := openStores(t)
+	defer release()
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			s.AddRenewTokens([]RenewToken{{Digest: "some_token", Family: "family", ExpireAt: time.Now().Add(time.Minute).Unix()}})
+
+			var retired int32
+			var wg sync.WaitGroup
+			wg.Add(10)
+			for i := 0; i < 10; i++ {
+				go func() {
+					defer wg.Done()
+					if ok, err := s.RetireRenewToken("some_token"); ok && err == nil {
+						atomic.AddInt32(&retired, 1)
+					}
+				}()
+			}
+			wg.Wait()
+			assert.Equal(t, int32(1), retired)
+		})
+	}
+}
+
+//fixtureDatabase creates bolt database at path with data written by fill, as if by older version of the service
+func fixtureDatabase(t *testing.T, path string, fill func(tx *bolt.Tx) error) *bolt.DB {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(fill); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+//unversionedFixture is layout of databases before schema versioning: renew tokens keyed by raw JWT
+//or in 8 bytes format and no user index
+func unversionedFixture(tx *bolt.Tx) error {
+	users, _ := tx.CreateBucket([]byte(userBucket))
+	tokens, _ := tx.CreateBucket([]byte(renewTokensBucket))
+
+	users.Put([]byte("jhondoe@testmail.com"), []byte(`{"email":"jhondoe@testmail.com","hashed_pwd":"hash","nickname":"JD"}`))
+	tokens.Put([]byte("header.payload.signature"), []byte(`{"email":"jhondoe@testmail.com","family":"family","expire_at":9999999999}`))
+
+	expireAt := make([]byte, 8)
+	binary.LittleEndian.PutUint64(expireAt, 9999999999)
+	return tokens.Put([]byte("legacy_token"), expireAt)
+}
+
+func TestMigrate_UnversionedDatabase(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "migrations")
+	defer os.RemoveAll(dir)
+	db := fixtureDatabase(t, filepath.Join(dir, "store.db"), unversionedFixture)
+	defer db.Close()
+
+	s, err := NewBoltStore(db)
+	assert.Nil(t, err)
+
+	db.View(func(tx *bolt.Tx) error {
+		version, err := schemaVersion(tx)
+		assert.Nil(t, err)
+		assert.Equal(t, SchemaVersion(), version)
+		return nil
+	})
+
+	found, user := s.GetUserByEmail("jhondoe@testmail.com")
+	assert.True(t, found)
+	assert.Equal(t, "JD", user.Nickname)
+	assert.NotEmpty(t, user.ID)
+	found, _ = s.GetUserByID(user.ID)
+	assert.True(t, found)
+	db.View(func(tx *bolt.Tx) error {
+		assert.Nil(t, tx.Bucket([]byte(userBucket)).Get([]byte("jhondoe@testmail.com")))
+		return nil
+	})
+
+	found, _ = s.GetRenewToken("header.payload.signature")
+	assert.False(t, found)
+	tokens := s.GetUserRenewTokens(user.ID)
+	assert.Len(t, tokens, 1)
+	assert.Equal(t, HashToken("header.payload.signature"), tokens[0].Digest)
+	assert.Equal(t, user.ID, tokens[0].UserID)
+	found, _ = s.GetRenewToken("legacy_token")
+	assert.True(t, found)
+
+	applied, err := Migrate(db, false)
+	assert.Nil(t, err)
+	assert.Empty(t, applied)
+}
+
+func TestMigrate_DryRun(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "migrations")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.db")
+	fixtureDatabase(t, path, unversionedFixture).Close()
+
+	pending, err := DryRunMigrations(path)
+	assert.Nil(t, err)
+	assert.Len(t, pending, len(migrations))
+	assert.Equal(t, 1, pending[0].Version)
+
+	db, _ := bolt.Open(path, 0600, nil)
+	defer db.Close()
+	db.View(func(tx *bolt.Tx) error {
+		assert.Nil(t, tx.Bucket([]byte(metaBucket)))
+		assert.Nil(t, tx.Bucket([]byte(userRenewTokensBucket)))
+		assert.NotNil(t, tx.Bucket([]byte(renewTokensBucket)).Get([]byte("header.payload.signature")))
+		return nil
+	})
+}
+
+func TestMigrate_DryRunWithoutDatabase(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "migrations")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.db")
+
+	_, err := DryRunMigrations(path)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMigrate_DryRunWithLockedDatabase(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "migrations")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.db")
+	db := fixtureDatabase(t, path, unversionedFixture)
+	defer db.Close()
+
+	_, err := DryRunMigrations(path)
+	assert.Equal(t, bolt.ErrTimeout, err)
+}
+
+func TestMigrate_Failure(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "migrations")
+	defer os.RemoveAll(dir)
+	db := fixtureDatabase(t, filepath.Join(dir, "store.db"), unversionedFixture)
+	defer db.Close()
+
+	defer func(applied []Migration) { migrations = applied }(migrations)
+	migrations = append(migrations[:len(migrations):len(migrations)], Migration{
+		Version: SchemaVersion() + 1,
+		up: func(tx *bolt.Tx) error {
+			tx.Bucket([]byte(metaBucket)).Put([]byte("broken"), []byte("1"))
+			return errors.New("broken migration")
+		},
+	})
+
+	applied, err := Migrate(db, false)
+	assert.NotNil(t, err)
+	assert.Len(t, applied, len(migrations)-1)
+
+	db.View(func(tx *bolt.Tx) error {
+		version, _ := schemaVersion(tx)
+		assert.Equal(t, SchemaVersion()-1, version)
+		assert.Nil(t, tx.Bucket([]byte(metaBucket)).Get([]byte("broken")))
+		return nil
+	})
+}
+
+func TestMigrate_NewerDatabase(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "migrations")
+	defer os.RemoveAll(dir)
+	db := fixtureDatabase(t, filepath.Join(dir, "store.db"), func(tx *bolt.Tx) error {
+		meta, _ := tx.CreateBucket([]byte(metaBucket))
+		return meta.Put(schemaVersionKey, []byte(strconv.Itoa(SchemaVersion()+1)))
+	})
+	defer db.Close()
+
+	_, err := NewBoltStore(db)
+	assert.NotNil(t, err)
+}
+
+func TestCanonicalEmail(t *testing.T) {
+	cases := []struct {
+		email, canonical, withProviderRules string
+	}{
+		{"jhondoe@testmail.com", "jhondoe@testmail.com", "jhondoe@testmail.com"},
+		{"  Jhon.Doe+tag@TestMail.COM\n", "jhon.doe+tag@testmail.com", "jhon.doe+tag@testmail.com"},
+		{"Jhon.Doe+tag@Gmail.com", "jhon.doe+tag@gmail.com", "jhondoe@gmail.com"},
+		{"jhon.doe@googlemail.com", "jhon.doe@googlemail.com", "jhondoe@gmail.com"},
+		{"not an email", "not an email", "not an email"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.canonical, canonicalEmail(c.email, false), c.email)
+		assert.Equal(t, c.withProviderRules, canonicalEmail(c.email, true), c.email)
+	}
+}
+
+func TestMigrate_EmailCollisions(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "migrations")
+	defer os.RemoveAll(dir)
+	db := fixtureDatabase(t, filepath.Join(dir, "store.db"), func(tx *bolt.Tx) error {
+		if err := createBuckets(tx); err != nil {
+			return err
+		}
+		tx.Bucket([]byte(metaBucket)).Put(schemaVersionKey, []byte("3"))
+		users := tx.Bucket([]byte(userBucket))
+		emails := tx.Bucket([]byte(userEmailsBucket))
+		for id, email := range map[string]string{"bob1": "Bob@Example.com", "bob2": "bob@example.com", "alice": "Alice@Example.COM"} {
+			users.Put([]byte(id), []byte(`{"id":"`+id+`","email":"`+email+`","hashed_pwd":"hash"}`))
+			emails.Put([]byte(email), []byte(id))
+		}
+		tx.Bucket([]byte(renewTokensBucket)).Put([]byte("digest"), []byte(`{"email":"Alice@Example.COM","family":"family","expire_at":9999999999}`))
+		return tx.Bucket([]byte(userRenewTokensBucket)).Put(userTokenKey("Alice@Example.COM", "digest"), nil)
+	})
+	defer db.Close()
+
+	s, err := NewBoltStore(db)
+	assert.Nil(t, err)
+
+	found, user := s.GetUserByEmail("alice@example.com")
+	assert.True(t, found)
+	assert.Equal(t, "alice", user.ID)
+	assert.Equal(t, "alice@example.com", user.Email)
+	found, _ = s.GetUserByEmail("Alice@Example.COM")
+	assert.False(t, found)
+	assert.Empty(t, s.GetUserRenewTokens("Alice@Example.COM"))
+	found, _ = s.GetRenewToken("digest")
+	assert.False(t, found)
+
+	found, user = s.GetUserByEmail("Bob@Example.com")
+	assert.True(t, found)
+	assert.Equal(t, "bob1", user.ID)
+	found, user = s.GetUserByEmail("bob@example.com")
+	assert.True(t, found)
+	assert.Equal(t, "bob2", user.ID)
+}
+
+func TestMigrate_NicknameIndex(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "migrations")
+	defer os.RemoveAll(dir)
+	db := fixtureDatabase(t, filepath.Join(dir, "store.db"), func(tx *bolt.Tx) error {
+		if err := createBuckets(tx); err != nil {
+			return err
+		}
+		tx.Bucket([]byte(metaBucket)).Put(schemaVersionKey, []byte("4"))
+		users := tx.Bucket([]byte(userBucket))
+		for id, nickname := range map[string]string{"jd1": "JD", "jd2": "jd", "neo": "Neo", "root": "root", "anonymous": ""} {
+			users.Put([]byte(id), []byte(`{"id":"`+id+`","email":"`+id+`@testmail.com","nickname":"`+nickname+`"}`))
+		}
+		return nil
+	})
+	defer db.Close()
+
+	s, err := NewBoltStore(db)
+	assert.Nil(t, err)
+
+	found, user := s.GetUserByNickname("NEO")
+	assert.True(t, found)
+	assert.Equal(t, "neo", user.ID)
+	found, user = s.GetUserByNickname("root")
+	assert.True(t, found)
+	assert.Equal(t, "root", user.ID)
+	found, _ = s.GetUserByNickname("jd")
+	assert.False(t, found)
+}
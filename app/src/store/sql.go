@@ -0,0 +1,301 @@
+package store
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+//sqlSchema creates tables of SQLStore. Statements use syntax common for SQLite and PostgreSQL
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS users (
+		id         TEXT PRIMARY KEY,
+		email      TEXT NOT NULL UNIQUE,
+		hashed_pwd TEXT NOT NULL,
+		nickname   TEXT NOT NULL DEFAULT '',
+		first_name TEXT NOT NULL DEFAULT '',
+		last_name  TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS renew_tokens (
+		digest        TEXT PRIMARY KEY,
+		user_id       TEXT NOT NULL DEFAULT '',
+		email         TEXT NOT NULL,
+		family        TEXT NOT NULL,
+		expire_at     BIGINT NOT NULL,
+		max_expire_at BIGINT NOT NULL DEFAULT 0,
+		retired       BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at    BIGINT NOT NULL DEFAULT 0,
+		refreshed_at  BIGINT NOT NULL DEFAULT 0,
+		ip            TEXT NOT NULL DEFAULT '',
+		user_agent    TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS revoked_tokens (
+		id        TEXT PRIMARY KEY,
+		expire_at BIGINT NOT NULL
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS users_nickname ON users (lower(nickname)) WHERE nickname <> ''`,
+	`CREATE INDEX IF NOT EXISTS renew_tokens_user_id ON renew_tokens (user_id)`,
+	`CREATE INDEX IF NOT EXISTS renew_tokens_family ON renew_tokens (family)`,
+}
+
+const renewTokenColumns = `digest, user_id, email, family, expire_at, max_expire_at, retired, created_at, refreshed_at, ip, user_agent`
+
+//SQLStore keeps users and renew tokens in relational database. Queries use $n placeholders
+//understood by SQLite and PostgreSQL drivers
+type SQLStore struct {
+	db *sql.DB
+}
+
+//NewSQLStore creates store of database db and its tables
+func NewSQLStore(db *sql.DB) (*SQLStore, error) {
+	for _, statement := range sqlSchema {
+		if _, err := db.Exec(statement); err != nil {
+			return nil, err
+		}
+	}
+	return &SQLStore{db: db}, nil
+}
+
+//Create inserts user unless email or nickname is taken. Unique constraints make checks and insert atomic
+func (s *SQLStore) Create(user *User) error {
+	result, err := s.db.Exec(`INSERT INTO users (id, email, hashed_pwd, nickname, first_name, last_name)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT DO NOTHING`,
+		user.ID, user.Email, user.HashedPwd, user.Nickname, user.FirstName, user.LastName)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		if found, _ := s.GetUserByEmail(user.Email); found {
+			return ErrEmailTaken
+		}
+		return ErrNicknameTaken
+	}
+	return nil
+}
+
+//GetUserByID selects user by ID
+func (s *SQLStore) GetUserByID(id string) (bool, *User) {
+	return s.selectUser(`WHERE id = $1`, id)
+}
+
+//GetUserByEmail selects user by email
+func (s *SQLStore) GetUserByEmail(email string) (bool, *User) {
+	return s.selectUser(`WHERE email = $1`, email)
+}
+
+//GetUserByNickname selects user by nickname in any case
+func (s *SQLStore) GetUserByNickname(nickname string) (bool, *User) {
+	return s.selectUser(`WHERE nickname <> '' AND lower(nickname) = lower($1)`, nickname)
+}
+
+//SetEmail updates email of the user. Check of the email owner and update are done in one transaction
+func (s *SQLStore) SetEmail(id string, email string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var owner string
+	err = tx.QueryRow(`SELECT id FROM users WHERE email = $1`, email).Scan(&owner)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil && owner != id {
+		return ErrEmailTaken
+	}
+
+	result, err := tx.Exec(`UPDATE users SET email = $1 WHERE id = $2`, email, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) selectUser(where string, arg string) (bool, *User) {
+	var user User
+	err := s.db.QueryRow(`SELECT id, email, hashed_pwd, nickname, first_name, last_name FROM users `+where, arg).
+		Scan(&user.ID, &user.Email, &user.HashedPwd, &user.Nickname, &user.FirstName, &user.LastName)
+	if err == sql.ErrNoRows {
+		return false, &user
+	}
+	if err != nil {
+		log.Println("Error while getting user: ", err.Error())
+		return false, &user
+	}
+	return true, &user
+}
+
+//SetPassword updates hashed password of the user
+func (s *SQLStore) SetPassword(id string, hashedPwd string) error {
+	result, err := s.db.Exec(`UPDATE users SET hashed_pwd = $1 WHERE id = $2`, hashedPwd, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+//AddRenewTokens upserts renew tokens in one transaction
+func (s *SQLStore) AddRenewTokens(tokens []RenewToken) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tokens {
+		_, err := tx.Exec(`INSERT INTO renew_tokens (`+renewTokenColumns+`)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			ON CONFLICT (digest) DO UPDATE SET user_id = excluded.user_id, email = excluded.email, family = excluded.family,
+				expire_at = excluded.expire_at, max_expire_at = excluded.max_expire_at, retired = excluded.retired,
+				created_at = excluded.created_at, refreshed_at = excluded.refreshed_at,
+				ip = excluded.ip, user_agent = excluded.user_agent`,
+			t.Digest, t.UserID, t.Email, t.Family, t.ExpireAt, t.MaxExpireAt, t.Retired, t.CreatedAt, t.RefreshedAt, t.IP, t.UserAgent)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+//GetRenewToken selects unexpired renew token by digest
+func (s *SQLStore) GetRenewToken(digest string) (bool, *RenewToken) {
+	tokens, err := s.selectTokens(`WHERE digest = $1 AND expire_at > $2`, digest, time.Now().Unix())
+	if err != nil {
+		log.Println("Error while getting renew token: ", err.Error())
+	}
+	if len(tokens) == 0 {
+		return false, &RenewToken{}
+	}
+	return true, &tokens[0]
+}
+
+//RetireRenewToken marks renew token as exchanged by conditional update, so only one of concurrent callers succeeds
+func (s *SQLStore) RetireRenewToken(digest string) (bool, error) {
+	result, err := s.db.Exec(`UPDATE renew_tokens SET retired = TRUE WHERE digest = $1 AND NOT retired`, digest)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+//DeleteRenewToken deletes renew token by digest
+func (s *SQLStore) DeleteRenewToken(digest string) error {
+	_, err := s.db.Exec(`DELETE FROM renew_tokens WHERE digest = $1`, digest)
+	return err
+}
+
+//DeleteRenewFamily deletes all renew tokens of the family
+func (s *SQLStore) DeleteRenewFamily(family string) error {
+	_, err := s.db.Exec(`DELETE FROM renew_tokens WHERE family = $1`, family)
+	return err
+}
+
+//GetAllRenewTokens selects all unexpired renew tokens
+func (s *SQLStore) GetAllRenewTokens() []RenewToken {
+	tokens, err := s.selectTokens(`WHERE expire_at > $1`, time.Now().Unix())
+	if err != nil {
+		log.Println("Error while reading renew tokens: ", err.Error())
+	}
+	return tokens
+}
+
+//ClearRenewTokens deletes renew tokens expired before now in one transaction. Returns deleted tokens
+func (s *SQLStore) ClearRenewTokens(now int64) ([]RenewToken, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	cleared, err := scanTokens(tx.Query(`SELECT `+renewTokenColumns+` FROM renew_tokens WHERE expire_at < $1`, now))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM renew_tokens WHERE expire_at < $1`, now); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return cleared, tx.Commit()
+}
+
+//GetUserRenewTokens selects unexpired renew tokens of the user
+func (s *SQLStore) GetUserRenewTokens(userID string) []RenewToken {
+	tokens, err := s.selectTokens(`WHERE user_id = $1 AND expire_at > $2`, userID, time.Now().Unix())
+	if err != nil {
+		log.Println("Error while reading renew tokens: ", err.Error())
+	}
+	return tokens
+}
+
+//DeleteUserRenewTokens deletes all renew tokens of the user
+func (s *SQLStore) DeleteUserRenewTokens(userID string) error {
+	_, err := s.db.Exec(`DELETE FROM renew_tokens WHERE user_id = $1`, userID)
+	return err
+}
+
+//AddRevokedToken inserts ID of revoked auth token, revoking it again keeps the first record
+func (s *SQLStore) AddRevokedToken(id string, expireAt int64) error {
+	_, err := s.db.Exec(`INSERT INTO revoked_tokens (id, expire_at) VALUES ($1, $2) ON CONFLICT DO NOTHING`, id, expireAt)
+	return err
+}
+
+//IsTokenRevoked selects ID of revoked auth token
+func (s *SQLStore) IsTokenRevoked(id string) (bool, error) {
+	var found string
+	err := s.db.QueryRow(`SELECT id FROM revoked_tokens WHERE id = $1`, id).Scan(&found)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//ClearRevokedTokens deletes IDs of revoked auth tokens expired before now
+func (s *SQLStore) ClearRevokedTokens(now int64) error {
+	_, err := s.db.Exec(`DELETE FROM revoked_tokens WHERE expire_at < $1`, now)
+	return err
+}
+
+func (s *SQLStore) selectTokens(where string, args ...interface{}) ([]RenewToken, error) {
+	return scanTokens(s.db.Query(`SELECT `+renewTokenColumns+` FROM renew_tokens `+where, args...))
+}
+
+//scanTokens reads renew tokens from query result and closes it
+func scanTokens(rows *sql.Rows, err error) ([]RenewToken, error) {
+	tokens := make([]RenewToken, 0, 10)
+	if err != nil {
+		return tokens, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t RenewToken
+		err := rows.Scan(&t.Digest, &t.UserID, &t.Email, &t.Family, &t.ExpireAt, &t.MaxExpireAt, &t.Retired,
+			&t.CreatedAt, &t.RefreshedAt, &t.IP, &t.UserAgent)
+		if err != nil {
+			return tokens, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
@@ -0,0 +1,217 @@
+package verifier
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+//SigningMethodEdDSA signs and verifies tokens with Ed25519 keys according RFC 8037
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+//KeySet finds key for token signature verification
+type KeySet interface {
+	Keyfunc(token *jwt.Token) (interface{}, error)
+}
+
+//KeyFunc adapts jwt.Keyfunc to KeySet
+type KeyFunc func(token *jwt.Token) (interface{}, error)
+
+//Keyfunc calls f(token)
+func (f KeyFunc) Keyfunc(token *jwt.Token) (interface{}, error) {
+	return f(token)
+}
+
+//RemoteKeySet loads public keys from JWKS endpoint of the auth service
+type RemoteKeySet struct {
+	URL                string
+	Client             *http.Client
+	MinRefreshInterval time.Duration
+
+	mutex     sync.Mutex
+	keys      map[string]publicKey
+	fetchedAt time.Time
+}
+
+type publicKey struct {
+	alg string
+	key interface{}
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+//NewRemoteKeySet creates key set for JWKS url, e.g. "http://auth:8080/.well-known/jwks.json"
+func NewRemoteKeySet(url string) *RemoteKeySet {
+	return &RemoteKeySet{
+		URL:                url,
+		Client:             &http.Client{Timeout: 10 * time.Second},
+		MinRefreshInterval: time.Minute,
+	}
+}
+
+//Keyfunc returns key by "kid" header. Unknown keys are fetched again, but not often than MinRefreshInterval
+func (s *RemoteKeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key, ok := s.keys[kid]
+	if !ok && time.Since(s.fetchedAt) >= s.MinRefreshInterval {
+		if err := s.fetch(); err != nil {
+			return nil, err
+		}
+		key, ok = s.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("Unknown signing key: %s", kid)
+	}
+
+	if token.Method.Alg() != key.alg {
+		return nil, fmt.Errorf("Unexpected signing method: %s", token.Method.Alg())
+	}
+	return key.key, nil
+}
+
+func (s *RemoteKeySet) fetch() error {
+	s.fetchedAt = time.Now()
+
+	response, err := s.Client.Get(s.URL)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("Can't load JWKS: %s", response.Status)
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&jwks); err != nil {
+		return err
+	}
+
+	keys := make(map[string]publicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		key, err := jwk.public()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = publicKey{alg: jwk.Alg, key: key}
+	}
+	s.keys = keys
+	return nil
+}
+
+func (jwk jsonWebKey) public() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported curve: %s", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if jwk.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Unsupported curve: %s", jwk.Crv)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("Unsupported key type: %s", jwk.Kty)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+type signingMethodEdDSA struct{}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(private, []byte(signingString))), nil
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(public, []byte(signingString), sig) {
+		return errors.New("EdDSA signature is invalid")
+	}
+	return nil
+}
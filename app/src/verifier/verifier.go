@@ -0,0 +1,168 @@
+//Package verifier checks access tokens issued by the auth service.
+//It has no dependencies on the service storage, so other services can import it
+package verifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+//Token types stored in "typ" claim
+const (
+	AccessToken  = "access"
+	RefreshToken = "refresh"
+)
+
+//ErrMissingToken returned when request has no bearer token
+var ErrMissingToken = errors.New("Bearer token is missing")
+
+//ErrInvalidToken returned when token is malformed, expired or has invalid signature
+var ErrInvalidToken = errors.New("Token is invalid or expired")
+
+//ErrWrongTokenType returned when token of another type is used
+var ErrWrongTokenType = errors.New("Token has wrong type")
+
+//ErrRevokedToken returned when token was revoked
+var ErrRevokedToken = errors.New("Token is revoked")
+
+type contextKey struct{}
+
+//TypedClaims is a token payload which knows its token type and ID. Embed jwt.StandardClaims to implement it
+type TypedClaims interface {
+	jwt.Claims
+	TokenType() string
+	TokenID() string
+	VerifyIssuer(cmp string, req bool) bool
+	VerifyAudience(cmp string, req bool) bool
+}
+
+//Claims is a payload of access token
+type Claims struct {
+	Email     string `json:"email"`
+	Nickname  string `json:"nickname,omitempty"`
+	FirstName string `json:"first_name,omitempty"`
+	LastName  string `json:"last_name,omitempty"`
+	Type      string `json:"typ"`
+
+	jwt.StandardClaims
+}
+
+//TokenType returns type of token
+func (c *Claims) TokenType() string {
+	return c.Type
+}
+
+//TokenID returns unique ID of token from "jti" claim
+func (c *Claims) TokenID() string {
+	return c.Id
+}
+
+//Verifier validates signature, expiration, type, issuer and audience of tokens.
+//Empty Issuer or Audience are not checked. IsRevoked checks token by its ID
+type Verifier struct {
+	Keys      KeySet
+	TokenType string
+	Issuer    string
+	Audience  string
+	IsRevoked func(id string) bool
+}
+
+//New creates verifier of access tokens
+func New(keys KeySet) *Verifier {
+	return &Verifier{
+		Keys:      keys,
+		TokenType: AccessToken,
+	}
+}
+
+//Verify parses token into claims and validates it
+func (v *Verifier) Verify(tokenString string, claims TypedClaims) error {
+	token, err := jwt.ParseWithClaims(tokenString, claims, v.Keys.Keyfunc)
+	if err != nil || !token.Valid {
+		return ErrInvalidToken
+	}
+
+	if v.TokenType != "" && claims.TokenType() != v.TokenType {
+		return ErrWrongTokenType
+	}
+
+	if v.Issuer != "" && !claims.VerifyIssuer(v.Issuer, true) {
+		return ErrInvalidToken
+	}
+
+	if v.Audience != "" && !claims.VerifyAudience(v.Audience, true) {
+		return ErrInvalidToken
+	}
+
+	if v.IsRevoked != nil && v.IsRevoked(claims.TokenID()) {
+		return ErrRevokedToken
+	}
+	return nil
+}
+
+//Middleware rejects requests without valid bearer token and puts verified claims into request context
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := BearerToken(r)
+		if err != nil {
+			Unauthorized(w, err)
+			return
+		}
+
+		var claims Claims
+		if err := v.Verify(token, &claims); err != nil {
+			Unauthorized(w, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), &claims)))
+	})
+}
+
+//BearerToken extracts token from "Authorization: Bearer" header
+func BearerToken(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", ErrMissingToken
+	}
+
+	token := strings.TrimSpace(header[7:])
+	if token == "" {
+		return "", ErrMissingToken
+	}
+	return token, nil
+}
+
+//Unauthorized writes 401 response according RFC 6750
+func Unauthorized(w http.ResponseWriter, err error) {
+	code := "invalid_token"
+	if err == ErrMissingToken {
+		code = "invalid_request"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", `Bearer error="`+code+`"`)
+	w.WriteHeader(http.StatusUnauthorized)
+
+	response, _ := json.Marshal(map[string]string{
+		"error":             code,
+		"error_description": err.Error(),
+	})
+	w.Write(response)
+}
+
+//NewContext returns context with verified claims
+func NewContext(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, contextKey{}, claims)
+}
+
+//FromContext returns verified claims from context
+func FromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(contextKey{}).(*Claims)
+	return claims, ok
+}
@@ -0,0 +1,142 @@
+package verifier
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims Claims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func validClaims(tokenType string) Claims {
+	return Claims{
+		Email: "jhondoe@testmail.com",
+		Type:  tokenType,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		},
+	}
+}
+
+func jwksServer(t *testing.T, ecKey *ecdsa.PrivateKey, edKey ed25519.PrivateKey) (*httptest.Server, *int) {
+	requests := 0
+	encode := base64.RawURLEncoding.EncodeToString
+
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "EC", "alg": "ES256", "kid": "ec-key", "crv": "P-256",
+				"x": encode(ecKey.X.Bytes()), "y": encode(ecKey.Y.Bytes()),
+			},
+			{
+				"kty": "OKP", "alg": "EdDSA", "kid": "ed-key", "crv": "Ed25519",
+				"x": encode(edKey.Public().(ed25519.PublicKey)),
+			},
+		},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	return server, &requests
+}
+
+func TestVerify_WithRemoteKeySet(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	server, requests := jwksServer(t, ecKey, edKey)
+	defer server.Close()
+
+	v := New(NewRemoteKeySet(server.URL))
+
+	var claims Claims
+	err := v.Verify(signToken(t, jwt.SigningMethodES256, ecKey, "ec-key", validClaims(AccessToken)), &claims)
+	assert.Nil(t, err)
+	assert.Equal(t, "jhondoe@testmail.com", claims.Email)
+
+	err = v.Verify(signToken(t, SigningMethodEdDSA, edKey, "ed-key", validClaims(AccessToken)), &Claims{})
+	assert.Nil(t, err)
+
+	err = v.Verify(signToken(t, SigningMethodEdDSA, edKey, "unknown-key", validClaims(AccessToken)), &Claims{})
+	assert.Equal(t, ErrInvalidToken, err)
+
+	assert.Equal(t, 1, *requests)
+}
+
+func TestVerify_WithInvalidTokens(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	v := New(KeyFunc(func(token *jwt.Token) (interface{}, error) {
+		return ecKey.Public(), nil
+	}))
+
+	expired := validClaims(AccessToken)
+	expired.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+
+	assert.Equal(t, ErrInvalidToken, v.Verify("invalid.token", &Claims{}))
+	assert.Equal(t, ErrInvalidToken, v.Verify(signToken(t, jwt.SigningMethodES256, ecKey, "", expired), &Claims{}))
+	assert.Equal(t, ErrInvalidToken, v.Verify(signToken(t, jwt.SigningMethodES256, otherKey, "", validClaims(AccessToken)), &Claims{}))
+	assert.Equal(t, ErrWrongTokenType, v.Verify(signToken(t, jwt.SigningMethodES256, ecKey, "", validClaims(RefreshToken)), &Claims{}))
+
+	revoked := validClaims(AccessToken)
+	revoked.Id = "revoked_id"
+	v.IsRevoked = func(id string) bool { return id == "revoked_id" }
+	assert.Equal(t, ErrRevokedToken, v.Verify(signToken(t, jwt.SigningMethodES256, ecKey, "", revoked), &Claims{}))
+	assert.Nil(t, v.Verify(signToken(t, jwt.SigningMethodES256, ecKey, "", validClaims(AccessToken)), &Claims{}))
+}
+
+func TestMiddleware(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	v := New(KeyFunc(func(token *jwt.Token) (interface{}, error) {
+		return ecKey.Public(), nil
+	}))
+
+	handler := v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := FromContext(r.Context())
+		assert.True(t, ok)
+		w.Write([]byte(claims.Email))
+	}))
+
+	request := func(header string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := request("Bearer " + signToken(t, jwt.SigningMethodES256, ecKey, "", validClaims(AccessToken)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "jhondoe@testmail.com", rr.Body.String())
+
+	rr = request("")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, `Bearer error="invalid_request"`, rr.Header().Get("WWW-Authenticate"))
+
+	rr = request("Bearer invalid.token")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, `Bearer error="invalid_token"`, rr.Header().Get("WWW-Authenticate"))
+}